@@ -0,0 +1,216 @@
+package addrbook
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"publicchain/conf"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 地址簿中的一个节点地址
+type KnownAddress struct {
+	Addr        string // 节点监听的地址
+	Services    uint64 // 对方提供的服务，握手成功后才知道
+	LastSeen    int64  // 最后一次知道这个节点在线的时间
+	LastAttempt int64  // 最后一次尝试连接的时间
+	Successes   int    // 连接并握手成功的次数
+	Failures    int    // 连续连接失败的次数，成功一次就清零
+}
+
+// 节点地址簿，记录从种子节点和其他节点那里知道的地址，可以被多个goroutine同时使用
+type AddrBook struct {
+	mu       sync.Mutex
+	addrs    map[string]*KnownAddress
+	dirty    bool   // 有没有还没保存的修改
+	filePath string // 持久化的文件
+}
+
+// 持久化到文件的地址簿
+type bookFile struct {
+	Addrs []*KnownAddress
+}
+
+// 创建地址簿
+func New() *AddrBook {
+	return &AddrBook{addrs: make(map[string]*KnownAddress)}
+}
+
+// 创建地址簿，并加载节点上次保存的地址
+func Load(nodeID string) *AddrBook {
+	book := New()
+	book.filePath = fmt.Sprintf(conf.PeersFile, nodeID)
+	if _, err := os.Stat(book.filePath); os.IsNotExist(err) {
+		return book
+	}
+	fileContent, err := ioutil.ReadFile(book.filePath)
+	if err != nil {
+		log.Panic(err)
+	}
+	var content bookFile
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&content); err != nil {
+		fmt.Println("地址簿文件损坏，忽略:", err)
+		return book
+	}
+	for _, ka := range content.Addrs {
+		book.addrs[ka.Addr] = ka
+	}
+	fmt.Printf("从文件加载了%d个节点地址\n", len(book.addrs))
+	return book
+}
+
+// 把地址簿保存到文件，没有修改时不写文件
+func (book *AddrBook) Save() error {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if book.filePath == "" || !book.dirty {
+		return nil
+	}
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(bookFile{book.sorted()})
+	if err != nil {
+		return err
+	}
+	book.dirty = false
+	return ioutil.WriteFile(book.filePath, content.Bytes(), 0644)
+}
+
+// 地址数量
+func (book *AddrBook) Count() int {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	return len(book.addrs)
+}
+
+// 添加一个地址，已经有的地址更新最后在线时间
+// lastSeen是其他节点告诉我们的时间，不能比现在晚
+func (book *AddrBook) Add(addr string, services uint64, lastSeen int64) {
+	if addr == "" {
+		return
+	}
+	if now := time.Now().Unix(); lastSeen > now {
+		lastSeen = now
+	}
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	ka, ok := book.addrs[addr]
+	if !ok {
+		if len(book.addrs) >= conf.MaxAddrBookSize {
+			return
+		}
+		ka = &KnownAddress{Addr: addr}
+		book.addrs[addr] = ka
+	}
+	if lastSeen > ka.LastSeen {
+		ka.LastSeen = lastSeen
+	}
+	ka.Services |= services
+	book.dirty = true
+}
+
+// 开始连接一个地址
+func (book *AddrBook) Attempt(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if ka, ok := book.addrs[addr]; ok {
+		ka.LastAttempt = time.Now().Unix()
+		book.dirty = true
+	}
+}
+
+// 连接并握手成功
+func (book *AddrBook) Good(addr string, services uint64) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	ka, ok := book.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr}
+		book.addrs[addr] = ka
+	}
+	ka.LastSeen = time.Now().Unix()
+	ka.Services = services
+	ka.Successes++
+	ka.Failures = 0
+	book.dirty = true
+}
+
+// 连接失败，从来没有连上过并且失败次数太多的地址直接删掉
+func (book *AddrBook) Failed(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	ka, ok := book.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.Failures++
+	if ka.Successes == 0 && ka.Failures >= conf.MaxAddrFailures {
+		delete(book.addrs, addr)
+	}
+	book.dirty = true
+}
+
+// 挑选一个可以连接的地址，exclude里的地址不选，没有可选的返回空字符串
+// 连接失败过的地址要等一段时间才能再试，失败次数越多等得越久
+// 成功连上过的地址优先，其次是最近在线的地址
+func (book *AddrBook) Select(exclude map[string]bool) string {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	now := time.Now().Unix()
+	for _, ka := range book.sorted() {
+		if exclude[ka.Addr] {
+			continue
+		}
+		failures := ka.Failures
+		if failures > 6 {
+			failures = 6
+		}
+		retry := int64(conf.AddrRetryInterval/time.Second) << uint(failures)
+		if ka.LastAttempt > 0 && now-ka.LastAttempt < retry {
+			continue
+		}
+		return ka.Addr
+	}
+	return ""
+}
+
+// 最近在线的地址，最多max个，用来回复getaddr
+func (book *AddrBook) Addresses(max int) []KnownAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	var addrs []KnownAddress
+	for _, ka := range book.sorted() {
+		if len(addrs) >= max {
+			break
+		}
+		if ka.LastSeen == 0 {
+			continue
+		}
+		addrs = append(addrs, *ka)
+	}
+	return addrs
+}
+
+// 按优先级排序：成功连上过的在前，然后按最后在线时间从新到旧
+func (book *AddrBook) sorted() []*KnownAddress {
+	var addrs []*KnownAddress
+	for _, ka := range book.addrs {
+		addrs = append(addrs, ka)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if (addrs[i].Successes > 0) != (addrs[j].Successes > 0) {
+			return addrs[i].Successes > 0
+		}
+		if addrs[i].LastSeen != addrs[j].LastSeen {
+			return addrs[i].LastSeen > addrs[j].LastSeen
+		}
+		return addrs[i].Addr < addrs[j].Addr
+	})
+	return addrs
+}
@@ -0,0 +1,138 @@
+package addrbook
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"publicchain/conf"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 一个被封禁的节点地址
+type BanEntry struct {
+	Addr   string // 节点监听的地址
+	Until  int64  // 封禁到什么时候
+	Reason string // 封禁的原因
+}
+
+// 封禁列表，行为不当的节点在封禁期间不会连接它，也不接受它连进来，可以被多个goroutine同时使用
+type BanList struct {
+	mu       sync.Mutex
+	bans     map[string]*BanEntry
+	filePath string // 持久化的文件
+}
+
+// 持久化到文件的封禁列表
+type banFile struct {
+	Bans []*BanEntry
+}
+
+// 创建封禁列表
+func NewBanList() *BanList {
+	return &BanList{bans: make(map[string]*BanEntry)}
+}
+
+// 创建封禁列表，并加载节点上次保存的封禁
+func LoadBanList(nodeID string) *BanList {
+	list := NewBanList()
+	list.filePath = fmt.Sprintf(conf.BanListFile, nodeID)
+	if _, err := os.Stat(list.filePath); os.IsNotExist(err) {
+		return list
+	}
+	fileContent, err := ioutil.ReadFile(list.filePath)
+	if err != nil {
+		log.Panic(err)
+	}
+	var content banFile
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&content); err != nil {
+		fmt.Println("封禁列表文件损坏，忽略:", err)
+		return list
+	}
+	for _, ban := range content.Bans {
+		list.bans[ban.Addr] = ban
+	}
+	return list
+}
+
+// 把封禁列表保存到文件，已经过期的封禁不再保存
+func (list *BanList) Save() error {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if list.filePath == "" {
+		return nil
+	}
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(banFile{list.active()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(list.filePath, content.Bytes(), 0644)
+}
+
+// 封禁一个地址，已经封禁的地址延长到两次封禁中较晚的时间
+func (list *BanList) Ban(addr string, duration time.Duration, reason string) {
+	if addr == "" {
+		return
+	}
+	until := time.Now().Add(duration).Unix()
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if ban, ok := list.bans[addr]; ok && ban.Until > until {
+		return
+	}
+	list.bans[addr] = &BanEntry{addr, until, reason}
+}
+
+// 地址是否在封禁期间，过期的封禁顺便删掉
+func (list *BanList) IsBanned(addr string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	ban, ok := list.bans[addr]
+	if !ok {
+		return false
+	}
+	if ban.Until <= time.Now().Unix() {
+		delete(list.bans, addr)
+		return false
+	}
+	return true
+}
+
+// 还在封禁期间的地址，按地址排序
+func (list *BanList) List() []BanEntry {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	var bans []BanEntry
+	for _, ban := range list.active() {
+		bans = append(bans, *ban)
+	}
+	return bans
+}
+
+// 解除所有封禁
+func (list *BanList) Clear() {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.bans = make(map[string]*BanEntry)
+}
+
+func (list *BanList) active() []*BanEntry {
+	now := time.Now().Unix()
+	var bans []*BanEntry
+	for _, ban := range list.bans {
+		if ban.Until > now {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Addr < bans[j].Addr
+	})
+	return bans
+}
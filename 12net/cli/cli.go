@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"publicchain/conf"
 	"publicchain/utils"
 	"publicchain/wallet"
 )
@@ -34,6 +35,11 @@ func (cli *CLI) Run() {
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	testCmd := flag.NewFlagSet("test", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	rollbackCmd := flag.NewFlagSet("rollback", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
+	rpcCmd := flag.NewFlagSet("rpc", flag.ExitOnError)
 
 	//设置标签后的参数
 	flagFromData := sendBlockCmd.String("from", "", "转帐源地址")
@@ -42,7 +48,15 @@ func (cli *CLI) Run() {
 	flagCreateBlockChainData := createBlockChainCmd.String("address", "", "创世区块交易地址")
 	flagGetBalanceData := getBalanceCmd.String("address", "", "要查询的某个账户的余额")
 	flagMiner := startNodeCmd.String("miner", "", "定义挖矿奖励的地址")
+	flagSeeds := startNodeCmd.String("seeds", conf.SEED_NODES, "种子节点的地址，多个地址用逗号分隔")
+	flagRequireEncryption := startNodeCmd.Bool("requireencryption", false, "只接受加密连接，拒绝明文连接")
+	flagRPCAddr := startNodeCmd.String("rpcaddr", "", "JSON-RPC服务的地址，默认是localhost:节点端口+1000")
+	flagRPCMethod := rpcCmd.String("method", "", "要调用的RPC方法")
+	flagRPCParams := rpcCmd.String("params", "", "RPC参数，JSON数组")
+	flagRPCNode := rpcCmd.String("rpcaddr", "", "节点的RPC地址，默认是localhost:节点端口+1000")
 	flagMine := sendBlockCmd.Bool("mine", false, "是否在当前节点中立即验证")
+	flagFee := sendBlockCmd.Int64("fee", 0, "每笔转账支付给矿工的手续费")
+	flagNode := sendBlockCmd.String("node", conf.SEED_NODES, "接收交易的节点地址，多个地址用逗号分隔")
 
 	//解析
 	switch os.Args[1] {
@@ -86,6 +100,31 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "rollback":
+		err := rollbackCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "migratedb":
+		err := migrateDBCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "rpc":
+		err := rpcCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		printUsage()
 		os.Exit(1) //退出
@@ -107,7 +146,12 @@ func (cli *CLI) Run() {
 				os.Exit(1)
 			}
 		}
-		cli.send(from, to, amount, nodeID, *flagMine)
+		if *flagFee < 0 {
+			fmt.Println("手续费不能为负数")
+			printUsage()
+			os.Exit(1)
+		}
+		cli.send(from, to, amount, *flagFee, nodeID, *flagMine, *flagNode)
 	}
 	if printChainCmd.Parsed() {
 		cli.printChains(nodeID)
@@ -146,7 +190,31 @@ func (cli *CLI) Run() {
 	}
 
 	if startNodeCmd.Parsed() {
-		cli.startNode(nodeID, *flagMiner)
+		cli.startNode(nodeID, *flagMiner, *flagSeeds, *flagRequireEncryption, *flagRPCAddr)
+	}
+
+	if rollbackCmd.Parsed() {
+		cli.rollback(nodeID)
+	}
+
+	if migrateDBCmd.Parsed() {
+		cli.migrateDB(nodeID)
+	}
+
+	if listBannedCmd.Parsed() {
+		cli.listBanned(nodeID)
+	}
+
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned(nodeID)
+	}
+
+	if rpcCmd.Parsed() {
+		if *flagRPCMethod == "" {
+			printUsage()
+			os.Exit(1)
+		}
+		cli.callRPC(nodeID, *flagRPCNode, *flagRPCMethod, *flagRPCParams)
 	}
 
 }
@@ -162,9 +230,14 @@ func printUsage() {
 	fmt.Println("\tcreatewallet -- 创建钱包")
 	fmt.Println("\taddresslists -- 输出所有钱包地址")
 	fmt.Println("\tcreateblockchain -address DATA -- 创建创世区块")
-	fmt.Println("\tsend -from FROM -to TO -amount AMOUNT -mine -- 交易明细.")
+	fmt.Println("\tsend -from FROM -to TO -amount AMOUNT -fee FEE -mine -node ADDRESSES -- 交易明细.")
 	fmt.Println("\tprintchain - 输出信息:")
 	fmt.Println("\tgetbalance -address DATA -- 查询账户余额")
 	fmt.Println("\ttest -- 测试")
-	fmt.Println("\tstartnode -miner ADDRESS -- 启动节点服务器，并且指定挖矿奖励的地址.")
+	fmt.Println("\tstartnode -miner ADDRESS -seeds ADDRESSES -requireencryption -rpcaddr ADDRESS -- 启动节点服务器，并且指定挖矿奖励的地址、种子节点、是否只接受加密连接和RPC地址.")
+	fmt.Println("\trollback -- 回退最新的区块(调试用)")
+	fmt.Println("\tmigratedb -- 把旧格式的数据库升级到当前格式")
+	fmt.Println("\tlistbanned -- 输出被封禁的节点")
+	fmt.Println("\tclearbanned -- 解除所有封禁，节点正在运行时通过RPC立即生效")
+	fmt.Println("\trpc -method METHOD -params JSON -rpcaddr ADDRESS -- 通过JSON-RPC调用正在运行的节点，比如 rpc -method getblock -params '[\"HASH\"]'")
 }
@@ -0,0 +1,25 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"publicchain/addrbook"
+	"publicchain/pbcc"
+)
+
+// 解除所有封禁
+// 节点正在运行时封禁列表在节点的内存里，停止时会覆盖文件，所以通过RPC让节点自己解除
+func (cli *CLI) clearBanned(nodeID string) {
+	if pbcc.DBLocked(nodeID) {
+		cli.callRPC(nodeID, "", "clearbanned", "")
+		return
+	}
+	banList := addrbook.LoadBanList(nodeID)
+	count := len(banList.List())
+	banList.Clear()
+	if err := banList.Save(); err != nil {
+		fmt.Println("保存封禁列表失败:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("解除了%d个节点的封禁\n", count)
+}
@@ -8,7 +8,7 @@ func (cli *CLI) createGenesisBlockchain(address string, nodeID string) {
 	bc := pbcc.GetBlockchainObject(nodeID)
 	defer bc.DB.Close()
 	if bc != nil {
-		utxoSet := &pbcc.UTXOSet{bc}
+		utxoSet := &pbcc.UTXOSet{BlockChain: bc}
 		utxoSet.ResetUTXOSet()
 	}
 }
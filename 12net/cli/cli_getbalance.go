@@ -2,6 +2,7 @@ package cli
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"publicchain/pbcc"
 )
@@ -15,8 +16,10 @@ func (cli *CLI) getBalance(address string, nodeID string) {
 		os.Exit(1)
 	}
 	defer bc.DB.Close()
-	utxoSet := &pbcc.UTXOSet{bc}
-	utxoSet.ResetUTXOSet()
+	utxoSet := &pbcc.UTXOSet{BlockChain: bc}
+	if err := utxoSet.Recover(); err != nil {
+		log.Panic(err)
+	}
 	balance := utxoSet.GetBalance(address)
 	fmt.Printf("%s,一共有%d个Token\n", address, balance)
 }
@@ -0,0 +1,24 @@
+package cli
+
+import (
+	"fmt"
+	"publicchain/addrbook"
+	"publicchain/pbcc"
+	"time"
+)
+
+// 输出被封禁的节点，节点正在运行时文件里不是最新的封禁，通过RPC查询
+func (cli *CLI) listBanned(nodeID string) {
+	if pbcc.DBLocked(nodeID) {
+		cli.callRPC(nodeID, "", "listbanned", "")
+		return
+	}
+	bans := addrbook.LoadBanList(nodeID).List()
+	if len(bans) == 0 {
+		fmt.Println("没有被封禁的节点")
+		return
+	}
+	for _, ban := range bans {
+		fmt.Printf("%s\t封禁到:%s\t原因:%s\n", ban.Addr, time.Unix(ban.Until, 0).Format("2006-01-02 15:04:05"), ban.Reason)
+	}
+}
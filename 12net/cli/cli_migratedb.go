@@ -0,0 +1,15 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"publicchain/pbcc"
+)
+
+// 把旧格式的数据库升级到当前格式
+func (cli *CLI) migrateDB(nodeID string) {
+	if err := pbcc.MigrateDB(nodeID); err != nil {
+		fmt.Println("数据库升级失败:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"publicchain/pbcc"
+)
+
+// 根据撤销数据回退最新的区块，用于调试
+func (cli *CLI) rollback(nodeID string) {
+	bc := pbcc.GetBlockchainObject(nodeID)
+	if bc == nil {
+		fmt.Println("数据库不存在，无法回退")
+		os.Exit(1)
+	}
+	defer bc.DB.Close()
+	block, err := bc.RollbackTip()
+	if err != nil {
+		fmt.Println("回退失败:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("已回退区块%x，当前高度:%d\n", block.Hash, block.Height-1)
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"publicchain/conf"
+	"strconv"
+	"strings"
+)
+
+// 节点默认的RPC地址：节点端口加上conf.RPCPortOffset
+func defaultRPCAddress(nodeID string) string {
+	port, err := strconv.Atoi(nodeID)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("localhost:%d", port+conf.RPCPortOffset)
+}
+
+// 通过JSON-RPC调用正在运行的节点，密码从节点生成的cookie文件读取
+// params是JSON数组，为空时不传参数
+func (cli *CLI) callRPC(nodeID string, addr string, method string, params string) {
+	if addr == "" {
+		addr = defaultRPCAddress(nodeID)
+	}
+	cookie, err := ioutil.ReadFile(fmt.Sprintf(conf.RPCCookieFile, nodeID))
+	if err != nil {
+		fmt.Println("读取RPC密码失败，节点是否已经启动:", err)
+		os.Exit(1)
+	}
+	userPassword := strings.SplitN(strings.TrimSpace(string(cookie)), ":", 2)
+	if len(userPassword) != 2 {
+		fmt.Println("RPC密码文件的格式不对")
+		os.Exit(1)
+	}
+	request := map[string]interface{}{"jsonrpc": "2.0", "method": method, "id": 1}
+	if params != "" {
+		request["params"] = json.RawMessage(params)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		fmt.Println("参数不是合法的JSON:", err)
+		os.Exit(1)
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, "http://"+addr, bytes.NewReader(body))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	httpRequest.SetBasicAuth(userPassword[0], userPassword[1])
+	httpRequest.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpRequest)
+	if err != nil {
+		fmt.Println("RPC请求失败:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("RPC请求失败:", resp.Status)
+		os.Exit(1)
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		fmt.Println("RPC回复解析失败:", err)
+		os.Exit(1)
+	}
+	if response.Error != nil {
+		fmt.Printf("错误%d: %s\n", response.Error.Code, response.Error.Message)
+		os.Exit(1)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, response.Result, "", "  "); err != nil {
+		fmt.Println(string(response.Result))
+		return
+	}
+	fmt.Println(out.String())
+}
@@ -2,27 +2,38 @@ package cli
 
 import (
 	"fmt"
+	"log"
 	"publicchain/pbcc"
 	"publicchain/server"
 	"strconv"
+	"strings"
 )
 
-//转账
-func (cli *CLI) send(from []string, to []string, amount []string, nodeID string, mineNow bool) {
+// 转账
+// nodes是接收交易的节点地址，多个地址用逗号分隔，依次尝试直到有一个节点收下
+func (cli *CLI) send(from []string, to []string, amount []string, fee int64, nodeID string, mineNow bool, nodes string) {
 	blockchain := pbcc.GetBlockchainObject(nodeID)
-	utxoSet := &pbcc.UTXOSet{blockchain}
-	utxoSet.ResetUTXOSet()
+	utxoSet := &pbcc.UTXOSet{BlockChain: blockchain}
+	if err := utxoSet.Recover(); err != nil {
+		log.Panic(err)
+	}
 	defer blockchain.DB.Close()
 	if mineNow {
-		blockchain.MineNewBlock(from, to, amount, nodeID)
-		//转账成功以后，需要更新一下
-		utxoSet.Update()
+		//区块接到主链上的时候UTXO表已经一起更新了
+		if err := blockchain.MineNewBlock(from, to, amount, fee, nodeID); err != nil {
+			log.Panic(err)
+		}
 	} else {
-		// 把交易发送到矿工节点去进行验证
+		// 把交易发送到节点，节点会转发给其他节点，由矿工节点打包
 		fmt.Println("由矿工节点处理......")
 		value, _ := strconv.Atoi(amount[0])
-		tx := pbcc.NewSimpleTransaction(from[0], to[0], int64(value), utxoSet, []*pbcc.Transaction{}, nodeID)
-		// 向全节点发送一下
-		server.SendTx(server.KnowNodes[0], tx)
+		tx := pbcc.NewSimpleTransaction(from[0], to[0], int64(value), fee, utxoSet, []*pbcc.Transaction{}, nodeID)
+		for _, node := range strings.Split(nodes, ",") {
+			err := server.SubmitTx(strings.TrimSpace(node), blockchain.GetBestHeight(), tx)
+			if err == nil {
+				return
+			}
+			fmt.Printf("向节点%s提交交易失败: %v\n", node, err)
+		}
 	}
 }
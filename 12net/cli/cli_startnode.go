@@ -1,20 +1,48 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"publicchain/server"
 	"publicchain/wallet"
+	"strings"
+	"syscall"
 )
 
 // 启动节点服务
-func (cli *CLI) startNode(nodeID string, minerAdd string) {
+// requireEncrypt为true时只接受加密连接，rpcAddr为空时RPC服务使用默认地址
+// 收到SIGINT或者SIGTERM时停止节点，保存状态并关闭数据库后退出
+func (cli *CLI) startNode(nodeID string, minerAdd string, seeds string, requireEncrypt bool, rpcAddr string) {
 	// 启动服务器
 	fmt.Println(nodeID, minerAdd)
 	if minerAdd == "" || wallet.IsValidForAddress([]byte(minerAdd)) {
 		//  启动服务器
 		fmt.Printf("启动服务器:localhost:%s\n", nodeID)
-		server.StartServer(nodeID, minerAdd)
+		var seedList []string
+		for _, seed := range strings.Split(seeds, ",") {
+			if seed = strings.TrimSpace(seed); seed != "" {
+				seedList = append(seedList, seed)
+			}
+		}
+		if rpcAddr == "" {
+			rpcAddr = defaultRPCAddress(nodeID)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		node := server.NewNode(server.Config{
+			NodeID:            nodeID,
+			MinerAddress:      minerAdd,
+			Seeds:             seedList,
+			RequireEncryption: requireEncrypt,
+			RPCAddress:        rpcAddr,
+		})
+		if err := node.Start(ctx); err != nil {
+			fmt.Println("启动节点失败:", err)
+			os.Exit(1)
+		}
+		<-node.Done()
 
 	} else {
 		fmt.Println("指定的地址无效")
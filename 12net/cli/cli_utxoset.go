@@ -18,6 +18,6 @@ func (cli *CLI) TestMethod(nodeID string) {
 			fmt.Println("---------------------")
 		}
 	}
-	utxoSet := &pbcc.UTXOSet{blockchain}
+	utxoSet := &pbcc.UTXOSet{BlockChain: blockchain}
 	utxoSet.ResetUTXOSet()
 }
@@ -1,30 +1,131 @@
 package conf
 
-//256位Hash里面前面至少有16个零
+import "time"
+
+//256位Hash里面前面至少有16个零，这是最低难度，创世区块使用这个难度
 const TargetBit = 16
 
+const RetargetInterval = 10            //每隔多少个区块调整一次难度
+const TargetBlockSpacing = 10          //期望的出块间隔，单位秒
+const RetargetClamp = 4                //一次调整难度最多变化的倍数
+const MedianTimeBlocks = 11            //计算过去区块时间中位数使用的区块数
+const MaxFutureBlockTime = 2 * 60 * 60 //区块时间戳最多可以比当前时间晚多少秒
+
 const DBNAME = "blockchain_%s.db" //数据库名
 const BLOCKTABLENAME = "blocks"   //表名
 
+const DBLockTimeout = 100 * time.Millisecond //检查数据库是否被运行中的节点锁住时最多等多久
+
 const Version = byte(0x00)   //版本
 const AddressChecksumLen = 4 //校验和的长度
 
 const WalletFile = "Wallets_%s.dat"
 
+const MempoolFile = "mempool_%s.dat"    //交易池持久化的文件
+const MaxMempoolSize = 5 * 1024 * 1024  //交易池中交易的总字节数上限
+const MempoolExpiry = 72 * time.Hour    //交易在交易池中最多保留的时间
+const MempoolSaveInterval = time.Minute //交易池有变化时多久保存一次，节点停止时也会保存
+
 const UtxoTableName = "utxoTable" //UTXO的表名
 
-const PROTOCOL = "tcp"   // 采用TCP
-const COMMANDLENGTH = 12 // 发送消息的前12个字节指定了命令名(version)
-const NODE_VERSION = 1   // 节点的区块链版本
+const InitialBlockSubsidy = 10     //最开始每个区块的奖励，发行总量由它和减半周期算出来
+const SubsidyHalvingInterval = 100 //每隔多少个区块奖励减半
+const CoinbaseMaturity = 10        //coinbase交易的输出要经过多少个区块确认才能花费
+
+const MaxBlockSize = 1024 * 1024 //区块序列化后的最大字节数
+const CoinbaseReserveSize = 1024 //打包交易时给coinbase交易预留的字节数
+
+const ChainWorkTableName = "chainwork" //区块累计工作量的表名
+const UndoTableName = "undo"           //区块撤销数据的表名
+const MetaTableName = "meta"           //数据库信息的表名，记录数据库格式版本
+const HeaderTableName = "headers"      //区块头的表名，不用读交易就能获取区块头
+const InvalidTableName = "invalid"     //不合法区块的表名，接入UTXO表失败的区块记在这里
+
+const DBSchemaVersion = 4 //数据库格式版本：1是用gob存区块，2是用二进制编码存区块，3增加了区块头表，4的撤销数据改用二进制编码
+
+const PROTOCOL = "tcp"     // 采用TCP
+const COMMANDLENGTH = 12   // 发送消息的前12个字节指定了命令名(version)
+const NODE_VERSION = 4     // 节点的协议版本，版本2使用长连接和区块头同步，版本3的消息不再带发送方地址，版本4的消息内容改用二进制编码
+const MIN_NODE_VERSION = 4 // 能够连接的对方最低协议版本
+const USER_AGENT = "/publicchain:0.2.0/"
+
+// 服务标志 在version消息里告诉对方本节点能提供哪些服务
+const SERVICE_FULL_NODE uint64 = 1 << 0 //有完整的区块链，可以提供区块下载
+const SERVICE_MINER uint64 = 1 << 1     //挖矿节点
+const SERVICE_LIGHT uint64 = 1 << 2     //轻节点，不提供区块，比如命令行客户端
+
+// 节点之间的连接
+const NetworkMagic uint32 = 0x12ad0e7c          //网络标识，放在每条消息的开头
+const MaxMessageSize = MaxBlockSize + 64*1024   //一条消息最大的字节数，要能放下一个最大的区块
+const MaxSendQueue = 1000                       //每个连接等待发送的消息数量上限
+const DialTimeout = 10 * time.Second            //连接其他节点的超时时间
+const WriteTimeout = 30 * time.Second           //发送一条消息的超时时间
+const HandshakeTimeout = 10 * time.Second       //连接建立后多久没有完成握手就断开
+const MaxInboundPeers = 64                      //最多同时接受多少个连进来的连接
+const MaxOutboundPeers = 16                     //最多同时主动连接多少个节点
+const AcceptRetryDelay = 100 * time.Millisecond //接受连接出错后等多久再继续接受
+
+// 加密连接
+const SecureMagic uint32 = 0x12ad0e7e //主动连接的一方先发送这个标识，表示要进行加密握手
+const NodeKeyFile = "nodekey_%s.dat"  //节点身份私钥的文件，节点ID由身份公钥计算
+
+// 节点发现
+const SEED_NODES = "localhost:8000"        //默认的种子节点，多个地址用逗号分隔
+const PeersFile = "peers_%s.dat"           //节点地址簿持久化的文件
+const MaxAddrBookSize = 1000               //地址簿最多记录的地址数量
+const MaxAddrPerMsg = 1000                 //一个addr消息最多携带的地址数量
+const MaxAddrFailures = 5                  //从来没连上过的地址连续失败多少次后删掉
+const AddrRetryInterval = 30 * time.Second //连接失败的地址至少等多久再试，失败次数越多等得越久
+const TargetOutboundPeers = 4              //主动连接的节点数量目标
+const ConnectInterval = 5 * time.Second    //多久检查一次主动连接的节点数量
+
+// 节点行为评分 对方违反协议时增加分数，分数达到上限就断开连接并封禁一段时间
+const BanThreshold = 100             //行为不当的分数累计到多少就封禁
+const BanDuration = 24 * time.Hour   //封禁的时长
+const BanListFile = "banlist_%s.dat" //封禁列表持久化的文件
+const ScoreMalformedMessage = 100    //消息无法解析
+const ScoreInvalidBlock = 100        //发来不合法的区块
+const ScoreInvalidHeader = 100       //发来不合法的区块头
+const ScoreInvalidTx = 10            //发来不合法的交易
+const ScoreBogusRequest = 10         //请求的内容不对，比如不认识的数据类型
+const ScoreProtocolViolation = 20    //不遵守协议，比如握手完成前发送其他消息、消息超过数量上限
 
 // 命令
-const COMMAND_VERSION = "version"     //该消息的目的就是比较谁的链长
-const COMMAND_ADDR = "addr"           //消息没有实现具体的业务
-const COMMAND_BLOCK = "block"         //该消息是发送一个区块
-const COMMAND_INV = "inv"             //该消息是把自己的区块信息和
-const COMMAND_GETBLOCKS = "getblocks" //该消息是请求获取对方的所有区块的hash
-const COMMAND_GETDATA = "getdata"     //该消息是请求获取区块或者Tx的信息
-const COMMAND_TX = "tx"               //该消息是发送交易
+const COMMAND_VERSION = "version"       //握手消息，告诉对方协议版本、服务和链的高度
+const COMMAND_VERACK = "verack"         //回复对方的version消息，双方都收到verack后握手完成
+const COMMAND_ADDR = "addr"             //该消息是告诉对方自己知道的节点地址
+const COMMAND_GETADDR = "getaddr"       //该消息是请求对方知道的节点地址
+const COMMAND_BLOCK = "block"           //该消息是发送一个区块
+const COMMAND_INV = "inv"               //该消息是把自己的区块信息和
+const COMMAND_GETHEADERS = "getheaders" //该消息是根据区块定位器请求对方主链上的区块头
+const COMMAND_HEADERS = "headers"       //该消息是回复一批区块头
+const COMMAND_GETDATA = "getdata"       //该消息是请求获取区块或者Tx的信息
+const COMMAND_TX = "tx"                 //该消息是发送交易
+const COMMAND_NOTFOUND = "notfound"     //回复getdata请求的数据本节点没有
+const COMMAND_MEMPOOL = "mempool"       //请求对方用inv通知它交易池里的所有交易
+
+// 同步区块
+const MaxHeadersPerMsg = 2000                 //一个headers消息最多携带的区块头数量
+const MaxBlocksInFlightPerPeer = 16           //同时向一个节点请求的区块数量上限
+const BlockDownloadTimeout = 10 * time.Second //请求区块后多久没收到就换一个节点请求
+const HeadersTimeout = 30 * time.Second       //请求区块头后多久没收到就换一个节点同步
+const MaxPeerStalls = 3                       //节点超时多少次以后不再从它下载区块
+
+// 转发交易
+const MaxInvPerMsg = 1000                 //一个inv消息最多携带的hash数量
+const MaxKnownInventory = 5000            //每个连接最多记录多少个对方已经知道的区块和交易
+const TrickleInterval = 2 * time.Second   //多久把等待通知的交易合并成一个inv消息发送一次
+const TxRequestTimeout = 10 * time.Second //请求交易后多久没收到就换一个节点请求
+const MaxTxInFlightPerPeer = 100          //同时向一个节点请求的交易数量上限
+const MaxTxRequests = 20000               //等待下载的交易数量上限
+
+// JSON-RPC服务
+const RPCPortOffset = 1000                 //默认的RPC端口是节点端口加上这个数
+const RPCCookieFile = "rpc_%s.cookie"      //RPC密码的文件，节点启动时生成，停止时删除
+const RPCCookieUser = "__cookie__"         //HTTP基本认证的用户名，密码在cookie文件里
+const MaxRPCRequestSize = 4 * 1024 * 1024  //一个RPC请求最大的字节数
+const RPCTimeout = 30 * time.Second        //读取请求和发送回复的超时时间
+const RPCShutdownTimeout = 5 * time.Second //节点停止时等正在处理的RPC请求多久
 
 // 类型 用于区分Inv消息发送的是区块还是交易
 const BLOCK_TYPE = "block"
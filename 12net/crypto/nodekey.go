@@ -0,0 +1,64 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// 节点的身份密钥，加密握手时用来证明自己的身份，节点ID由公钥计算
+type NodeKey struct {
+	Private []byte
+	Public  []byte
+}
+
+// 生成一个新的密钥
+func NewNodeKey() (*NodeKey, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	return nodeKeyFromPrivate(private)
+}
+
+func nodeKeyFromPrivate(private []byte) (*NodeKey, error) {
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeKey{private, public}, nil
+}
+
+// 加载节点的身份密钥，文件不存在时生成一个并保存，以后节点ID不变
+func LoadNodeKey(filePath string) (*NodeKey, error) {
+	private, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		key, err := NewNodeKey()
+		if err != nil {
+			return nil, err
+		}
+		return key, ioutil.WriteFile(filePath, key.Private, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(private) != curve25519.ScalarSize {
+		return nil, errors.New("节点密钥文件的长度不对")
+	}
+	return nodeKeyFromPrivate(private)
+}
+
+// 节点ID：身份公钥的sha256的前20个字节，Base58编码
+func NodeID(public []byte) string {
+	hash := sha256.Sum256(public)
+	return string(Base58Encode(hash[:20]))
+}
+
+// 本节点的ID
+func (key *NodeKey) ID() string {
+	return NodeID(key.Public)
+}
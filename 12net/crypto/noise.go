@@ -0,0 +1,325 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 节点之间的加密连接，握手使用Noise协议的XX模式：
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// 双方交换临时公钥和身份公钥，握手完成后每个方向各用一个密钥加密，双方都知道对方的身份公钥
+const noiseProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+const noiseMaxMessage = 65535                                         //握手消息和加密记录的最大字节数
+const noiseMaxPlaintext = noiseMaxMessage - chacha20poly1305.Overhead //一个加密记录最多携带的明文字节数
+
+var ErrNoiseDecrypt = errors.New("加密数据解密失败")
+
+// 加密状态：密钥和递增的nonce，还没有密钥时不加密
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newCipherState(key []byte) *cipherState {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &cipherState{aead: aead}
+}
+
+func (cs *cipherState) encrypt(ad, plaintext []byte) []byte {
+	if cs == nil {
+		return plaintext
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+	return cs.aead.Seal(nil, nonce[:], plaintext, ad)
+}
+
+func (cs *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if cs == nil {
+		return ciphertext, nil
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	plaintext, err := cs.aead.Open(nil, nonce[:], ciphertext, ad)
+	if err != nil {
+		return nil, ErrNoiseDecrypt
+	}
+	cs.nonce++
+	return plaintext, nil
+}
+
+// 握手过程中的状态：ck用来派生密钥，h是到目前为止握手内容的hash，加密时作为附加数据
+type symmetricState struct {
+	cs *cipherState
+	ck []byte
+	h  []byte
+}
+
+func newSymmetricState(prologue []byte) *symmetricState {
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocolName)
+	ss := &symmetricState{ck: h, h: h}
+	ss.mixHash(prologue)
+	return ss
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(ss.h)
+	hash.Write(data)
+	ss.h = hash.Sum(nil)
+}
+
+// 用ck和输入派生两个32字节的密钥
+func (ss *symmetricState) hkdf(ikm []byte) ([]byte, []byte) {
+	out := make([]byte, 2*sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, ss.ck, nil), out); err != nil {
+		log.Panic(err)
+	}
+	return out[:sha256.Size], out[sha256.Size:]
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	ck, key := ss.hkdf(ikm)
+	ss.ck = ck
+	ss.cs = newCipherState(key)
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := ss.cs.encrypt(ss.h, plaintext)
+	ss.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := ss.cs.decrypt(ss.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// 握手完成，派生两个方向的密钥，第一个是发起方发送用的
+func (ss *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := ss.hkdf(nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+// 椭圆曲线DH，对方的公钥是小阶点时返回错误
+func dh(private, public []byte) ([]byte, error) {
+	return curve25519.X25519(private, public)
+}
+
+// 读取一个带长度前缀的数据，长度是2字节大端
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	if len(frame) > noiseMaxMessage {
+		return errors.New("加密记录太长")
+	}
+	buf := make([]byte, 2+len(frame))
+	binary.BigEndian.PutUint16(buf, uint16(len(frame)))
+	copy(buf[2:], frame)
+	_, err := w.Write(buf)
+	return err
+}
+
+// 主动连接的一方进行加密握手，prologue是双方都知道的内容，不一样时握手失败
+func SecureClient(conn net.Conn, key *NodeKey, prologue []byte) (*SecureConn, error) {
+	ss := newSymmetricState(prologue)
+	e, err := NewNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	// -> e
+	ss.mixHash(e.Public)
+	msg := append(append([]byte{}, e.Public...), ss.encryptAndHash(nil)...)
+	if err := writeFrame(conn, msg); err != nil {
+		return nil, err
+	}
+	// <- e, ee, s, es
+	msg, err = readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < 32+32+chacha20poly1305.Overhead {
+		return nil, errors.New("握手消息太短")
+	}
+	re := msg[:32]
+	ss.mixHash(re)
+	ee, err := dh(e.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(ee)
+	rs, err := ss.decryptAndHash(msg[32 : 32+32+chacha20poly1305.Overhead])
+	if err != nil {
+		return nil, err
+	}
+	es, err := dh(e.Private, rs)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(es)
+	if _, err := ss.decryptAndHash(msg[32+32+chacha20poly1305.Overhead:]); err != nil {
+		return nil, err
+	}
+	// -> s, se
+	msg = ss.encryptAndHash(key.Public)
+	se, err := dh(key.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(se)
+	msg = append(msg, ss.encryptAndHash(nil)...)
+	if err := writeFrame(conn, msg); err != nil {
+		return nil, err
+	}
+	send, recv := ss.split()
+	return &SecureConn{Conn: conn, send: send, recv: recv, remoteStatic: rs}, nil
+}
+
+// 被连接的一方进行加密握手
+func SecureServer(conn net.Conn, key *NodeKey, prologue []byte) (*SecureConn, error) {
+	ss := newSymmetricState(prologue)
+	// -> e
+	msg, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < 32 {
+		return nil, errors.New("握手消息太短")
+	}
+	re := msg[:32]
+	ss.mixHash(re)
+	if _, err := ss.decryptAndHash(msg[32:]); err != nil {
+		return nil, err
+	}
+	// <- e, ee, s, es
+	e, err := NewNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(e.Public)
+	ee, err := dh(e.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(ee)
+	msg = append(append([]byte{}, e.Public...), ss.encryptAndHash(key.Public)...)
+	es, err := dh(key.Private, re)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(es)
+	msg = append(msg, ss.encryptAndHash(nil)...)
+	if err := writeFrame(conn, msg); err != nil {
+		return nil, err
+	}
+	// -> s, se
+	msg, err = readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < 32+chacha20poly1305.Overhead {
+		return nil, errors.New("握手消息太短")
+	}
+	rs, err := ss.decryptAndHash(msg[:32+chacha20poly1305.Overhead])
+	if err != nil {
+		return nil, err
+	}
+	se, err := dh(e.Private, rs)
+	if err != nil {
+		return nil, err
+	}
+	ss.mixKey(se)
+	if _, err := ss.decryptAndHash(msg[32+chacha20poly1305.Overhead:]); err != nil {
+		return nil, err
+	}
+	recv, send := ss.split()
+	return &SecureConn{Conn: conn, send: send, recv: recv, remoteStatic: rs}, nil
+}
+
+// 握手完成后的加密连接，读写的数据都经过加密，可以当作普通的net.Conn使用
+// 同时只能有一个goroutine读、一个goroutine写
+type SecureConn struct {
+	net.Conn
+	send         *cipherState
+	recv         *cipherState
+	remoteStatic []byte // 对方的身份公钥
+	readBuf      []byte // 已经解密还没有读走的数据
+	writeMu      sync.Mutex
+}
+
+func (c *SecureConn) Read(b []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		record, err := readFrame(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf, err = c.recv.decrypt(nil, record)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *SecureConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > noiseMaxPlaintext {
+			chunk = chunk[:noiseMaxPlaintext]
+		}
+		if err := writeFrame(c.Conn, c.send.encrypt(nil, chunk)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// 对方的身份公钥
+func (c *SecureConn) RemoteStatic() []byte {
+	return c.remoteStatic
+}
+
+// 对方的节点ID
+func (c *SecureConn) RemoteID() string {
+	return NodeID(c.remoteStatic)
+}
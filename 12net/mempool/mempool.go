@@ -0,0 +1,305 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"publicchain/conf"
+	"publicchain/pbcc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 交易进入交易池失败的原因，交易本身不合法时返回pbcc.CheckTransaction的错误
+var (
+	ErrTxExists      = errors.New("交易已经在交易池中")
+	ErrCoinbase      = errors.New("coinbase交易不能进入交易池")
+	ErrDoubleSpend   = errors.New("交易的输入已经被花费")
+	ErrMissingInputs = errors.New("交易的输入引用的输出不存在")
+	ErrBadSignature  = errors.New("交易签名验证失败")
+	ErrPoolFull      = errors.New("交易池已满，交易的费率太低")
+	ErrImmatureSpend = errors.New("交易花费了还没有成熟的coinbase输出")
+)
+
+// 交易池中的一笔交易
+type TxDesc struct {
+	Tx    *pbcc.Transaction
+	Added time.Time // 进入交易池的时间
+	Fee   int64     // 手续费：输入总额-输出总额
+	Size  int       // 交易序列化后的字节数
+	seq   uint64    // 进入交易池的顺序，父交易一定比子交易小
+}
+
+// 费率：每字节的手续费
+func (desc *TxDesc) FeeRate() float64 {
+	if desc.Size == 0 {
+		return 0
+	}
+	return float64(desc.Fee) / float64(desc.Size)
+}
+
+// 交易池，可以被多个goroutine同时使用
+type TxPool struct {
+	mu       sync.RWMutex
+	utxoSet  *pbcc.UTXOSet
+	txs      map[string]*TxDesc // 交易ID -> 交易
+	spent    map[string]string  // 被交易池中的交易花掉的输出 -> 花掉它的交易ID
+	size     int                // 交易池中所有交易的总字节数
+	nextSeq  uint64
+	maxSize  int           // 交易池总字节数的上限
+	expiry   time.Duration // 交易在池子里最多保留的时间
+	filePath string        // 持久化的文件
+}
+
+// 创建交易池
+func New(bc *pbcc.BlockChain) *TxPool {
+	return &TxPool{
+		utxoSet: &pbcc.UTXOSet{BlockChain: bc},
+		txs:     make(map[string]*TxDesc),
+		spent:   make(map[string]string),
+		maxSize: conf.MaxMempoolSize,
+		expiry:  conf.MempoolExpiry,
+	}
+}
+
+// 输出的唯一标识：交易ID:下标
+func outpointKey(txID []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txID, vout)
+}
+
+// 把交易加入交易池，校验不通过时返回错误
+func (pool *TxPool) Add(tx *pbcc.Transaction) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.expire()
+	return pool.add(tx)
+}
+
+func (pool *TxPool) add(tx *pbcc.Transaction) error {
+	if err := pbcc.CheckTransaction(tx); err != nil {
+		return err
+	}
+	txID := hex.EncodeToString(tx.TxID)
+	if pool.txs[txID] != nil {
+		return ErrTxExists
+	}
+	if tx.IsCoinbaseTransaction() {
+		return ErrCoinbase
+	}
+	// 检查每个输入：没有被池子里的交易花掉，引用的输出在UTXO表或者池子里
+	var spent []*pbcc.TXOuput
+	spendHeight := pool.utxoSet.BlockChain.GetBestHeight() + 1
+	for _, vin := range tx.Vins {
+		if pool.spent[outpointKey(vin.TxID, vin.Vout)] != "" {
+			return ErrDoubleSpend
+		}
+		if parent := pool.txs[hex.EncodeToString(vin.TxID)]; parent != nil {
+			if vin.Vout >= len(parent.Tx.Vouts) {
+				return ErrMissingInputs
+			}
+			spent = append(spent, parent.Tx.Vouts[vin.Vout])
+			continue
+		}
+		utxo := pool.utxoSet.FindUTXO(vin.TxID, vin.Vout)
+		if utxo == nil {
+			return ErrMissingInputs
+		}
+		if !utxo.IsMature(spendHeight) {
+			return ErrImmatureSpend
+		}
+		spent = append(spent, utxo.Output)
+	}
+	// 金额：输入总额不能小于输出总额，差额就是手续费
+	fee, err := pbcc.CheckTransactionInputs(tx, spent)
+	if err != nil {
+		return err
+	}
+	// 签名用上面从UTXO表和池子里找到的输出验证，持有锁的时候不能扫描区块链
+	if !tx.VerifySignatures(spent) {
+		return ErrBadSignature
+	}
+
+	desc := &TxDesc{tx, time.Now(), fee, len(tx.Serialize()), pool.nextSeq}
+	pool.nextSeq++
+	pool.txs[txID] = desc
+	pool.size += desc.Size
+	for _, vin := range tx.Vins {
+		pool.spent[outpointKey(vin.TxID, vin.Vout)] = txID
+	}
+	// 超过上限时按费率从低到高淘汰，刚加进来的交易被淘汰说明费率太低
+	pool.evict()
+	if pool.txs[txID] == nil {
+		return ErrPoolFull
+	}
+	return nil
+}
+
+// 交易池超过大小上限时，淘汰费率最低的交易，费率一样时淘汰进入时间早的
+func (pool *TxPool) evict() {
+	if pool.size <= pool.maxSize {
+		return
+	}
+	descs := pool.sortedDescs()
+	sort.SliceStable(descs, func(i, j int) bool {
+		if descs[i].FeeRate() != descs[j].FeeRate() {
+			return descs[i].FeeRate() < descs[j].FeeRate()
+		}
+		return descs[i].Added.Before(descs[j].Added)
+	})
+	for _, desc := range descs {
+		if pool.size <= pool.maxSize {
+			return
+		}
+		pool.remove(desc.Tx.TxID, true)
+	}
+}
+
+// 删除在池子里待太久的交易
+func (pool *TxPool) expire() {
+	deadline := time.Now().Add(-pool.expiry)
+	for _, desc := range pool.sortedDescs() {
+		if desc.Added.Before(deadline) {
+			pool.remove(desc.Tx.TxID, true)
+		}
+	}
+}
+
+// 从交易池删除交易，withDescendants为true时同时删除花费它输出的交易
+func (pool *TxPool) remove(txIDBytes []byte, withDescendants bool) {
+	txID := hex.EncodeToString(txIDBytes)
+	desc := pool.txs[txID]
+	if desc == nil {
+		return
+	}
+	delete(pool.txs, txID)
+	pool.size -= desc.Size
+	for _, vin := range desc.Tx.Vins {
+		delete(pool.spent, outpointKey(vin.TxID, vin.Vout))
+	}
+	if !withDescendants {
+		return
+	}
+	for index := range desc.Tx.Vouts {
+		if child := pool.spent[outpointKey(desc.Tx.TxID, index)]; child != "" {
+			childID, _ := hex.DecodeString(child)
+			pool.remove(childID, true)
+		}
+	}
+}
+
+// 按进入交易池的顺序返回所有交易，父交易在子交易前面
+func (pool *TxPool) sortedDescs() []*TxDesc {
+	descs := make([]*TxDesc, 0, len(pool.txs))
+	for _, desc := range pool.txs {
+		descs = append(descs, desc)
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		return descs[i].seq < descs[j].seq
+	})
+	return descs
+}
+
+// 主链发生变化后更新交易池
+// 接入主链的交易从池子里删掉，和它们冲突的交易也删掉；断开区块里的交易重新校验后放回池子
+func (pool *TxPool) ProcessTipChange(change *pbcc.TipChange) {
+	if change == nil {
+		return
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, block := range change.Connected {
+		for _, tx := range block.Txs {
+			pool.remove(tx.TxID, false)
+			if tx.IsCoinbaseTransaction() {
+				continue
+			}
+			for _, vin := range tx.Vins {
+				if conflict := pool.spent[outpointKey(vin.TxID, vin.Vout)]; conflict != "" {
+					conflictID, _ := hex.DecodeString(conflict)
+					pool.remove(conflictID, true)
+				}
+			}
+		}
+	}
+	// 从最老的断开区块开始放回，保证父交易先进入池子
+	for i := len(change.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range change.Disconnected[i].Txs {
+			if tx.IsCoinbaseTransaction() {
+				continue
+			}
+			if err := pool.add(tx); err != nil {
+				fmt.Printf("断开区块中的交易%x没有放回交易池: %v\n", tx.TxID, err)
+			}
+		}
+	}
+	if len(change.Disconnected) > 0 {
+		pool.removeInvalidSpends()
+	}
+}
+
+// 主链回退以后，断开区块里的coinbase输出没有了，coinbase输出成熟需要的高度也可能不够了
+// 删除引用了不存在或者还没成熟的输出的交易
+func (pool *TxPool) removeInvalidSpends() {
+	spendHeight := pool.utxoSet.BlockChain.GetBestHeight() + 1
+	for _, desc := range pool.sortedDescs() {
+		if pool.txs[hex.EncodeToString(desc.Tx.TxID)] == nil {
+			continue //作为前面交易的子交易已经被删掉了
+		}
+		for _, vin := range desc.Tx.Vins {
+			if pool.txs[hex.EncodeToString(vin.TxID)] != nil {
+				continue
+			}
+			utxo := pool.utxoSet.FindUTXO(vin.TxID, vin.Vout)
+			if utxo == nil || !utxo.IsMature(spendHeight) {
+				pool.remove(desc.Tx.TxID, true)
+				break
+			}
+		}
+	}
+}
+
+// 根据交易ID获取交易，不存在时返回nil
+func (pool *TxPool) Get(txID []byte) *pbcc.Transaction {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if desc := pool.txs[hex.EncodeToString(txID)]; desc != nil {
+		return desc.Tx
+	}
+	return nil
+}
+
+// 判断交易是否在交易池中
+func (pool *TxPool) Has(txID []byte) bool {
+	return pool.Get(txID) != nil
+}
+
+// 交易池中的交易数量
+func (pool *TxPool) Count() int {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	return len(pool.txs)
+}
+
+// 按进入交易池的顺序返回所有交易，父交易在子交易前面
+func (pool *TxPool) Transactions() []*pbcc.Transaction {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	var txs []*pbcc.Transaction
+	for _, desc := range pool.sortedDescs() {
+		txs = append(txs, desc.Tx)
+	}
+	return txs
+}
+
+// 按进入交易池的顺序返回所有交易的详细信息
+func (pool *TxPool) TxDescs() []*TxDesc {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	var descs []*TxDesc
+	for _, desc := range pool.sortedDescs() {
+		descCopy := *desc
+		descs = append(descs, &descCopy)
+	}
+	return descs
+}
@@ -0,0 +1,67 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"publicchain/conf"
+	"publicchain/pbcc"
+)
+
+// 持久化到文件的交易池，每笔交易按pbcc的二进制格式编码
+type poolFile struct {
+	Txs [][]byte
+}
+
+// 创建交易池，并加载节点上次保存的交易
+// 文件里的交易会重新校验，已经打包或者失效的交易直接丢弃
+func Load(bc *pbcc.BlockChain, nodeID string) *TxPool {
+	pool := New(bc)
+	pool.filePath = fmt.Sprintf(conf.MempoolFile, nodeID)
+	if _, err := os.Stat(pool.filePath); os.IsNotExist(err) {
+		return pool
+	}
+	fileContent, err := ioutil.ReadFile(pool.filePath)
+	if err != nil {
+		log.Panic(err)
+	}
+	var content poolFile
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	if err := decoder.Decode(&content); err != nil {
+		fmt.Println("交易池文件损坏，忽略:", err)
+		return pool
+	}
+	for _, txBytes := range content.Txs {
+		tx, err := pbcc.DecodeTransaction(txBytes)
+		if err != nil {
+			fmt.Println("交易池文件中的交易解析失败，忽略:", err)
+			continue
+		}
+		if err := pool.Add(tx); err != nil {
+			fmt.Printf("交易%x没有加载到交易池: %v\n", tx.TxID, err)
+		}
+	}
+	fmt.Printf("从文件加载了%d笔交易到交易池\n", pool.Count())
+	return pool
+}
+
+// 把交易池保存到文件，父交易在子交易前面，加载时可以按顺序放回
+func (pool *TxPool) Save() error {
+	if pool.filePath == "" {
+		return nil
+	}
+	var txs [][]byte
+	for _, tx := range pool.Transactions() {
+		txs = append(txs, tx.Serialize())
+	}
+	var content bytes.Buffer
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(poolFile{txs})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pool.filePath, content.Bytes(), 0644)
+}
@@ -0,0 +1,57 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"publicchain/pbcc"
+	"sort"
+)
+
+// 区块模板：矿工要打包进区块的交易，不包括coinbase交易
+type BlockTemplate struct {
+	Txs  []*pbcc.Transaction // 父交易在子交易前面
+	Fees int64               // 所有交易的手续费总额
+	Size int                 // 所有交易的总字节数
+}
+
+// 按费率从高到低挑选交易，总字节数不超过maxSize
+// 交易池里的父交易被选中以后，子交易才能被选中
+func (pool *TxPool) NewBlockTemplate(maxSize int) *BlockTemplate {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+
+	descs := pool.sortedDescs()
+	sort.SliceStable(descs, func(i, j int) bool {
+		return descs[i].FeeRate() > descs[j].FeeRate()
+	})
+	template := &BlockTemplate{}
+	selected := make(map[string]bool)
+	// 每一轮按费率顺序挑一遍，父交易在本轮被选中后，子交易下一轮还有机会
+	for {
+		progress := false
+		for _, desc := range descs {
+			txID := hex.EncodeToString(desc.Tx.TxID)
+			if selected[txID] || template.Size+desc.Size > maxSize || !pool.parentsSelected(desc.Tx, selected) {
+				continue
+			}
+			selected[txID] = true
+			template.Txs = append(template.Txs, desc.Tx)
+			template.Fees += desc.Fee
+			template.Size += desc.Size
+			progress = true
+		}
+		if !progress {
+			return template
+		}
+	}
+}
+
+// 判断交易在交易池里的父交易是否都已经被选中
+func (pool *TxPool) parentsSelected(tx *pbcc.Transaction, selected map[string]bool) bool {
+	for _, vin := range tx.Vins {
+		parentID := hex.EncodeToString(vin.TxID)
+		if pool.txs[parentID] != nil && !selected[parentID] {
+			return false
+		}
+	}
+	return true
+}
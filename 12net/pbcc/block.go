@@ -1,34 +1,62 @@
 package pbcc
 
 import (
-	"bytes"
-	"encoding/gob"
 	"log"
+	"math/big"
 	"time"
 )
 
-//Block结构体
-type Block struct {
-	//字段：
+//区块头的版本，旧格式数据库升级上来的区块版本为0
+const BlockVersion uint32 = 1
+
+//区块头：区块hash只根据区块头计算，交易通过默克尔根包含在区块头里
+//只有区块头也可以校验工作量证明和区块之间的链接，不需要下载交易
+type BlockHeader struct {
+	//版本Version
+	Version uint32
 	//高度Height：其实就是区块的编号，第一个区块叫创世区块，高度为0
 	Height int64
 	//上一个区块的哈希值ProvHash：
 	PrevBlockHash []byte
+	//交易的默克尔根MerkleRoot
+	MerkleRoot []byte
+	//时间戳TimeStamp：
+	TimeStamp int64
+	//难度目标Bits：target的压缩格式
+	Bits uint32
+	// 随机数
+	Nonce int64
+}
+
+//Block结构体
+type Block struct {
+	//区块头，Height、PrevBlockHash等字段可以直接通过block访问
+	BlockHeader
 	//交易数据Data：目前先设计为[]byte,后期是Transaction
 	//Data []byte
 	Txs []*Transaction
-	//时间戳TimeStamp：
-	TimeStamp int64
 	//哈希值Hash：32个的字节，64个16进制数
 	Hash []byte
-	// 随机数
-	Nonce int64
 }
 
-//创建新的区块
-func NewBlock(txs []*Transaction, provBlockHash []byte, height int64) *Block {
+//判断是否是创世区块：上一个区块的hash全为0
+func (header *BlockHeader) isGenesis() bool {
+	hashInt := new(big.Int)
+	hashInt.SetBytes(header.PrevBlockHash)
+	return big.NewInt(0).Cmp(hashInt) == 0
+}
+
+//创建还没有挖矿的区块，默克尔根在这里算好，挖矿时每次只需要计算区块头的hash
+func newBlockTemplate(txs []*Transaction, provBlockHash []byte, height int64, bits uint32, timestamp int64) *Block {
+	block := &Block{BlockHeader{BlockVersion, height, provBlockHash, nil, timestamp, bits, 0}, txs, nil}
+	block.MerkleRoot = block.HashTransactions()
+	return block
+}
+
+//创建新的区块，bits是区块的难度目标
+func NewBlock(txs []*Transaction, provBlockHash []byte, height int64, bits uint32) *Block {
 	//创建区块
-	block := &Block{height, provBlockHash, txs, time.Now().Unix(), nil, 0}
+	block := newBlockTemplate(txs, provBlockHash, height, bits, time.Now().Unix())
 	//调用工作量证明的方法，并且返回有效的Hash和Nonce
 	pow := NewProofOfWork(block)
 	hash, nonce := pow.Run()
@@ -39,35 +67,24 @@ func NewBlock(txs []*Transaction, provBlockHash []byte, height int64) *Block {
 
 //创建创世区块：
 func CreateGenesisBlock(txs []*Transaction) *Block {
-	return NewBlock(txs, make([]byte, 32), 0)
+	return NewBlock(txs, make([]byte, 32), 0, PowLimitBits())
 }
 
-//将区块序列化，得到一个字节数组---区块的行为
+//将区块序列化，得到一个字节数组---区块的行为，格式见encoding.go
 func (block *Block) Serilalize() []byte {
-	//1.创建一个buffer
-	var result bytes.Buffer
-	//2.创建一个编码器
-	encoder := gob.NewEncoder(&result)
-	//3.编码--->打包
-	err := encoder.Encode(block)
-	if err != nil {
-		log.Panic(err)
-	}
-	return result.Bytes()
+	e := NewEncoder()
+	block.encode(e)
+	return e.Bytes()
 }
 
 //反序列化，得到一个区块
+//只用来读取自己数据库里的区块，其他节点发来的区块用DecodeBlock
 func DeserializeBlock(blockBytes []byte) *Block {
-	var block Block
-	var reader = bytes.NewReader(blockBytes)
-	//1.创建一个解码器
-	decoder := gob.NewDecoder(reader)
-	//解包
-	err := decoder.Decode(&block)
+	block, err := DecodeBlock(blockBytes)
 	if err != nil {
 		log.Panic(err)
 	}
-	return &block
+	return block
 }
 
 //将Txs转为[]byte
@@ -12,6 +12,7 @@ import (
 	"publicchain/crypto"
 	"publicchain/wallet"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -19,8 +20,9 @@ import (
 
 //创建区块链
 type BlockChain struct {
-	Tip []byte   // 最新区块的Hash值
-	DB  *bolt.DB //数据库对象
+	Tip     []byte       // 最新区块的Hash值，要通过GetTipHash读取
+	DB      *bolt.DB     //数据库对象
+	tipLock sync.RWMutex // 保护Tip，和数据库里的"l"在同一个写事务里更新
 }
 
 //创建区块链，带有创世区块
@@ -40,55 +42,94 @@ func CreateBlockChainWithGenesisBlock(address string, nodeID string) {
 	//数据库不存在，说明第一次创建，然后存入到数据库中
 	//创建创世区块
 	//先创建coinbase交易
-	txCoinBase := NewCoinBaseTransaction(address)
+	txCoinBase := NewCoinBaseTransaction(address, 0, 0)
 	genesisBlock := CreateGenesisBlock([]*Transaction{txCoinBase})
+	if err := CreateBlockChainAt(DBNAME, genesisBlock); err != nil {
+		log.Panic(err)
+	}
+}
+
+//在指定路径创建区块链数据库，存入给定的创世区块
+//创世区块相同的数据库属于同一个网络，可以互相同步
+func CreateBlockChainAt(dbPath string, genesisBlock *Block) error {
+	if dbExists(dbPath) {
+		return fmt.Errorf("数据库%s已经存在", dbPath)
+	}
 	//打开数据库
-	db, err := bolt.Open(DBNAME, 0600, nil)
+	db, err := bolt.Open(dbPath, 0600, nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer db.Close()
 	//存入数据表
-	err = db.Update(func(tx *bolt.Tx) error {
+	return db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket([]byte(conf.BLOCKTABLENAME))
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		if b != nil {
-			err = b.Put(genesisBlock.Hash, genesisBlock.Serilalize())
-			if err != nil {
-				log.Panic("创世区块存储有误")
-			}
-			//存储最新区块的hash
-			b.Put([]byte("l"), genesisBlock.Hash)
+		if err := putBlock(tx, genesisBlock); err != nil {
+			return fmt.Errorf("创世区块存储有误: %v", err)
 		}
+		//存储最新区块的hash
+		if err := b.Put([]byte("l"), genesisBlock.Hash); err != nil {
+			return err
+		}
+		return setDBSchemaVersion(tx)
+	})
+}
+
+//打开指定路径的区块链数据库，数据库不存在或者格式版本不对时返回错误
+func OpenBlockChainAt(dbPath string) (*BlockChain, error) {
+	if !dbExists(dbPath) {
+		return nil, fmt.Errorf("数据库%s不存在", dbPath)
+	}
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	var blockchain *BlockChain
+	err = db.View(func(tx *bolt.Tx) error {
+		if version := dbSchemaVersion(tx); version != conf.DBSchemaVersion {
+			return fmt.Errorf("数据库格式版本是%d，程序需要的版本是%d，请先运行 migratedb 升级数据库", version, conf.DBSchemaVersion)
+		}
+		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
+		if b == nil {
+			return fmt.Errorf("数据库%s中没有区块链", dbPath)
+		}
+		blockchain = &BlockChain{Tip: append([]byte(nil), b.Get([]byte("l"))...), DB: db}
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
 	}
+	return blockchain, nil
 }
 
 //添加一个新的区块，到区块链中
 func (bc *BlockChain) AddBlockToBlockChain(txs []*Transaction) {
 	//更新数据库
-	err := bc.DB.Update(func(tx *bolt.Tx) error {
+	err := bc.updateTip(func(tx *bolt.Tx) error {
 		//打开表
 		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
 		if b != nil {
 			//根据最新块的hash读取数据，并反序列化最后一个区块
-			blockBytes := b.Get(bc.Tip)
+			blockBytes := b.Get(b.Get([]byte("l")))
 			lastBlock := DeserializeBlock(blockBytes)
+			//计算新区块的难度
+			bits, err := calcNextBits(&lastBlock.BlockHeader, txHeaderGetter(tx))
+			if err != nil {
+				log.Panic(err)
+			}
 			//创建新的区块
-			newBlock := NewBlock(txs, lastBlock.Hash, lastBlock.Height+1)
+			newBlock := NewBlock(txs, lastBlock.Hash, lastBlock.Height+1, bits)
 			//将新的区块序列化并存储
-			err := b.Put(newBlock.Hash, newBlock.Serilalize())
+			err = putBlock(tx, newBlock)
 			if err != nil {
 				log.Panic(err)
 			}
-			//更新最后一个哈希值，以及blockchain的tip
-			b.Put([]byte("l"), newBlock.Hash)
-			bc.Tip = newBlock.Hash
+			//更新最后一个哈希值，blockchain的tip由updateTip更新
+			return b.Put([]byte("l"), newBlock.Hash)
 		}
 		return nil
 	})
@@ -97,9 +138,34 @@ func (bc *BlockChain) AddBlockToBlockChain(txs []*Transaction) {
 	}
 }
 
+//在写事务里更新数据库，事务结束前把Tip改成数据库里"l"的值
+//整个事务期间持有写锁，其他地方不会读到还没提交的tip；事务失败时Tip保持原样
+//fn里不能再调用GetTipHash，否则会死锁
+func (bc *BlockChain) updateTip(fn func(tx *bolt.Tx) error) error {
+	bc.tipLock.Lock()
+	defer bc.tipLock.Unlock()
+	oldTip := bc.Tip
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
+		if b == nil {
+			return fmt.Errorf("区块表不存在")
+		}
+		//b.Get返回的数据只在事务里有效，要复制出来
+		bc.Tip = append([]byte(nil), b.Get([]byte("l"))...)
+		return nil
+	})
+	if err != nil {
+		bc.Tip = oldTip
+	}
+	return err
+}
+
 //获取一个迭代器
 func (bc *BlockChain) Iterator() *BlockChainIterator {
-	return &BlockChainIterator{bc.Tip, bc.DB}
+	return &BlockChainIterator{bc.GetTipHash(), bc.DB}
 }
 
 // 借助迭代器输出区块链
@@ -113,8 +179,10 @@ func (bc *BlockChain) PrintChains() {
 		fmt.Printf("第%d个区块的信息:\n", block.Height+1)
 		//获取当前hash对应的数据，并进行反序列化
 		fmt.Printf("\t高度:%d\n", block.Height)
+		fmt.Printf("\t版本:%d\n", block.Version)
 		fmt.Printf("\t上一个区块的hash:%x\n", block.PrevBlockHash)
 		fmt.Printf("\t当前的hash:%x\n", block.Hash)
+		fmt.Printf("\t默克尔根:%x\n", block.MerkleRoot)
 		//fmt.Printf("\t数据：%v\n", block.Txs)
 		fmt.Println("\t交易:")
 		for _, tx := range block.Txs {
@@ -132,6 +200,7 @@ func (bc *BlockChain) PrintChains() {
 			}
 		}
 		fmt.Printf("\t时间:%s\n", time.Unix(block.TimeStamp, 0).Format("2006-01-02 15:04:05"))
+		fmt.Printf("\t难度:%08x\n", block.Bits)
 		fmt.Printf("\t次数:%d\n", block.Nonce)
 
 		//3.直到父hash值为0
@@ -151,6 +220,23 @@ func dbExists(DBName string) bool {
 	return true
 }
 
+// 数据库是否被正在运行的节点打开了，节点运行时独占数据库文件的锁
+// 这时命令行不能直接修改节点的数据和状态文件，要通过RPC让节点自己改
+func DBLocked(nodeID string) bool {
+	DBNAME := fmt.Sprintf(conf.DBNAME, nodeID)
+	if !dbExists(DBNAME) {
+		return false
+	}
+	db, err := bolt.Open(DBNAME, 0600, &bolt.Options{Timeout: conf.DBLockTimeout, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return true
+	}
+	if err == nil {
+		db.Close()
+	}
+	return false
+}
+
 // 获取最新的区块链
 func GetBlockchainObject(nodeID string) *BlockChain {
 	DBNAME := fmt.Sprintf(conf.DBNAME, nodeID)
@@ -166,16 +252,17 @@ func GetBlockchainObject(nodeID string) *BlockChain {
 	if err != nil {
 		log.Fatal(err)
 	}
+	checkDBSchemaVersion(db)
 	var blockchain *BlockChain
 	//读取数据库
 	err = db.View(func(tx *bolt.Tx) error {
 		//打开表
 		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
 		if b != nil {
-			//读取最后一个hash
-			hash := b.Get([]byte("l"))
+			//读取最后一个hash，b.Get返回的数据只在事务里有效，要复制出来
+			hash := append([]byte(nil), b.Get([]byte("l"))...)
 			//创建blockchain
-			blockchain = &BlockChain{hash, db}
+			blockchain = &BlockChain{Tip: hash, DB: db}
 		}
 		return nil
 	})
@@ -248,12 +335,12 @@ outputs:
 					}
 				}
 				if !isSpentUTXO {
-					utxo := &UTXO{tx.TxID, index, out}
+					utxo := &UTXO{TxID: tx.TxID, Index: index, Output: out}
 					unUTXOs = append(unUTXOs, utxo)
 				}
 
 			} else {
-				utxo := &UTXO{tx.TxID, index, out}
+				utxo := &UTXO{TxID: tx.TxID, Index: index, Output: out}
 				unUTXOs = append(unUTXOs, utxo)
 			}
 		}
@@ -282,52 +369,74 @@ func (bc *BlockChain) FindSpendableUTXOs(from string, amount int64, txs []*Trans
 	return balance, spendableUTXO
 }
 
-//挖掘新的区块 有交易的时候就会调用
-func (bc *BlockChain) MineNewBlock(from, to, amount []string, nodeID string) {
+// 挖掘新的区块 有交易的时候就会调用，每笔转账支付fee的手续费
+// 新区块和收到的区块一样经过AddBlock校验后接到主链上，UTXO表在同一个事务里更新
+func (bc *BlockChain) MineNewBlock(from, to, amount []string, fee int64, nodeID string) error {
 	//新建交易
 	//新建区块
 	//将区块存入到数据库
-	var txs []*Transaction
-	//奖励
-	tx := NewCoinBaseTransaction(from[0])
-	txs = append(txs, tx)
+	var transfers []*Transaction
 	utxoSet := &UTXOSet{bc}
 	for i := 0; i < len(from); i++ {
 		amountInt, _ := strconv.ParseInt(amount[i], 10, 64)
-		tx := NewSimpleTransaction(from[i], to[i], amountInt, utxoSet, txs, nodeID)
-		txs = append(txs, tx)
+		tx := NewSimpleTransaction(from[i], to[i], amountInt, fee, utxoSet, transfers, nodeID)
+		transfers = append(transfers, tx)
 	}
 
-	var block *Block    //数据库中的最后一个block
-	var newBlock *Block //要创建的新的block
-	bc.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
-		if b != nil {
-			hash := b.Get([]byte("l"))
-			blockBytes := b.Get(hash)
-			block = DeserializeBlock(blockBytes) //数据库中的最后一个block
-		}
-		return nil
-	})
-	//在建立新区块钱，对txs进行签名验证
-	_txs := []*Transaction{}
-	for _, tx := range txs {
-		if bc.VerifyTransaction(tx, _txs) != true {
-			log.Panic("签名验证失败。。")
-		}
-		_txs = append(_txs, tx)
+	block := bc.GetTipBlock() //数据库中的最后一个block
+	//奖励：新区块高度对应的区块奖励加上所有转账实际支付的手续费
+	//按交易实际的输入和输出计算，不假设每笔转账正好支付了fee
+	fees, err := bc.calcFees(block.Hash, transfers, block.Height+1)
+	if err != nil {
+		return err
 	}
+	tx := NewCoinBaseTransaction(from[0], block.Height+1, fees)
+	txs := append([]*Transaction{tx}, transfers...)
 
-	newBlock = NewBlock(txs, block.Hash, block.Height+1)
-	bc.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
-		if b != nil {
-			b.Put(newBlock.Hash, newBlock.Serilalize())
-			b.Put([]byte("l"), newBlock.Hash)
-			bc.Tip = newBlock.Hash
+	bits, err := bc.CalcNextBits(&block.BlockHeader)
+	if err != nil {
+		return err
+	}
+	newBlock := NewBlock(txs, block.Hash, block.Height+1, bits)
+	//签名、余额和难度都由AddBlock校验，不合法的区块不会存进数据库
+	change, err := bc.AddBlock(newBlock)
+	if err != nil {
+		return err
+	}
+	if change == nil {
+		return fmt.Errorf("区块%x没有接到主链上", newBlock.Hash)
+	}
+	return nil
+}
+
+// 计算接在tipHash后面、高度为height的区块里这些交易的手续费总额，每笔交易的手续费是输入总额减去输出总额
+// 后面的交易可以花前面交易的输出，和校验区块时一样通过UTXO视图查找输入
+func (bc *BlockChain) calcFees(tipHash []byte, txs []*Transaction, height int64) (int64, error) {
+	var fees int64
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		view, err := newUTXOView(tx, tipHash)
+		if err != nil {
+			return err
 		}
-		return nil
+		for _, transaction := range txs {
+			var spent []*TXOuput
+			for _, vin := range transaction.Vins {
+				var out *TXOuput
+				if utxo := view.spend(vin.TxID, vin.Vout); utxo != nil {
+					out = utxo.Output
+				}
+				spent = append(spent, out)
+			}
+			fee, err := CheckTransactionInputs(transaction, spent)
+			if err != nil {
+				return fmt.Errorf("交易%x: %v", transaction.TxID, err)
+			}
+			fees += fee
+			view.addTransaction(transaction, height)
+		}
+		return checkValue(fees)
 	})
+	return fees, err
 }
 
 // 获取余额
@@ -342,7 +451,12 @@ func (bc *BlockChain) GetBalance(address string, txs []*Transaction) int64 {
 
 //根据交易ID查找对应的Transaction
 func (bc *BlockChain) FindTransactionByTxID(txID []byte, txs []*Transaction) *Transaction {
-	itertaor := bc.Iterator()
+	return bc.findTransactionFrom(bc.GetTipHash(), txID, txs)
+}
+
+//从指定的区块开始往前查找交易，用于校验不在主链上的分叉区块
+func (bc *BlockChain) findTransactionFrom(blockHash []byte, txID []byte, txs []*Transaction) *Transaction {
+	itertaor := &BlockChainIterator{blockHash, bc.DB}
 	//先遍历txs
 	for _, tx := range txs {
 		if bytes.Equal(txID, tx.TxID) {
@@ -381,16 +495,6 @@ func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey,
 	tx.Sign(privKey, prevTxs)
 }
 
-//区块链层的交易签名验证
-func (bc *BlockChain) VerifyTransaction(tx *Transaction, txs []*Transaction) bool {
-	prevTXs := make(map[string]*Transaction)
-	for _, vin := range tx.Vins {
-		prevTx := bc.FindTransactionByTxID(vin.TxID, txs)
-		prevTXs[hex.EncodeToString(prevTx.TxID)] = prevTx
-	}
-	return tx.Verify(prevTXs)
-}
-
 //查询未花费的Output map[string] *TxOutputs
 func (bc *BlockChain) FindUnSpentOutputMap() map[string]*TxOutputs {
 	iterator := bc.Iterator()
@@ -426,12 +530,12 @@ func (bc *BlockChain) FindUnSpentOutputMap() map[string]*TxOutputs {
 						}
 					}
 					if !isSpent {
-						utxo := &UTXO{tx.TxID, index, out}
+						utxo := &UTXO{tx.TxID, index, out, block.Height, tx.IsCoinbaseTransaction()}
 						txOutputs.UTXOS = append(txOutputs.UTXOS, utxo)
 					}
 
 				} else {
-					utxo := &UTXO{tx.TxID, index, out}
+					utxo := &UTXO{tx.TxID, index, out, block.Height, tx.IsCoinbaseTransaction()}
 					txOutputs.UTXOS = append(txOutputs.UTXOS, utxo)
 				}
 			}
@@ -457,6 +561,23 @@ func (bc *BlockChain) GetBestHeight() int64 {
 	return block.Height
 }
 
+//获取最新区块的hash
+func (bc *BlockChain) GetTipHash() []byte {
+	bc.tipLock.RLock()
+	defer bc.tipLock.RUnlock()
+	return bc.Tip
+}
+
+//获取最新区块
+func (bc *BlockChain) GetTipBlock() *Block {
+	return bc.Iterator().Next()
+}
+
+//关闭数据库
+func (bc *BlockChain) Close() error {
+	return bc.DB.Close()
+}
+
 //获取所有区块的hash
 func (bc *BlockChain) GetBlockHashes() [][]byte {
 	blockIterator := bc.Iterator()
@@ -473,6 +594,47 @@ func (bc *BlockChain) GetBlockHashes() [][]byte {
 	return blockHashs
 }
 
+//根据高度获取主链上区块的hash，从最新的区块沿着区块头往前找
+func (bc *BlockChain) GetBlockHashByHeight(height int64) ([]byte, error) {
+	hash := bc.GetTipHash()
+	header, err := bc.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+	if height < 0 || height > header.Height {
+		return nil, fmt.Errorf("高度%d超出了主链的范围0-%d", height, header.Height)
+	}
+	for header.Height > height {
+		hash = header.PrevBlockHash
+		if header, err = bc.GetHeader(hash); err != nil {
+			return nil, err
+		}
+	}
+	return hash, nil
+}
+
+//在主链上查找交易，返回交易和所在区块的hash，找不到时返回nil
+func (bc *BlockChain) FindTransaction(txID []byte) (*Transaction, []byte) {
+	blockIterator := bc.Iterator()
+	for {
+		block := blockIterator.Next()
+		for _, tx := range block.Txs {
+			if bytes.Equal(txID, tx.TxID) {
+				return tx, block.Hash
+			}
+		}
+		if block.isGenesis() {
+			return nil, nil
+		}
+	}
+}
+
+//找到某地址在UTXO表里的所有未花费输出
+func (bc *BlockChain) FindUnspentOutputs(address string) []*UTXO {
+	utxoSet := &UTXOSet{BlockChain: bc}
+	return utxoSet.FindUnspentOutputsForAddress(address)
+}
+
 //根据hash获取区块
 func (bc *BlockChain) GetBlock(blockHash []byte) ([]byte, error) {
 	var blockBytes []byte
@@ -486,32 +648,133 @@ func (bc *BlockChain) GetBlock(blockHash []byte) ([]byte, error) {
 	return blockBytes, err
 }
 
-//添加区块到数据库
-func (bc *BlockChain) AddBlock(block *Block) {
-	err := bc.DB.Update(func(tx *bolt.Tx) error {
+//存储区块，同时把区块头存到区块头表，难度调整和计算工作量时只需要读区块头
+func putBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
+	if b == nil {
+		return fmt.Errorf("区块表不存在")
+	}
+	if err := b.Put(block.Hash, block.Serilalize()); err != nil {
+		return err
+	}
+	headers, err := tx.CreateBucketIfNotExists([]byte(conf.HeaderTableName))
+	if err != nil {
+		return err
+	}
+	return headers.Put(block.Hash, block.BlockHeader.Serialize())
+}
+
+//根据hash获取区块头
+func (bc *BlockChain) GetHeader(blockHash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+	err := bc.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		header, err = txHeaderGetter(tx)(blockHash)
+		return err
+	})
+	return header, err
+}
+
+//根据hash获取区块对象
+func (bc *BlockChain) findBlock(blockHash []byte) (*Block, error) {
+	blockBytes, err := bc.GetBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	if blockBytes == nil {
+		return nil, fmt.Errorf("区块%x不存在", blockHash)
+	}
+	return DeserializeBlock(blockBytes), nil
+}
+
+//添加区块到数据库，区块校验不通过时返回错误，不会存储
+//分叉链上的区块也会存下来，哪条链累计的工作量大，哪条链就是主链
+//主链发生切换时返回断开和接入的区块，没有切换时返回nil
+func (bc *BlockChain) AddBlock(block *Block) (*TipChange, error) {
+	var change *TipChange
+	var failed *Block //切换主链时接入UTXO表失败的区块
+	err := bc.updateTip(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
-		if b != nil {
-			blockExist := b.Get(block.Hash)
-			if blockExist != nil {
-				// 如果存在，不需要做任何过多的处理
-				return nil
-			}
-			err := b.Put(block.Hash, block.Serilalize())
-			if err != nil {
-				log.Panic(err)
+		if b == nil {
+			return fmt.Errorf("区块表不存在")
+		}
+		if b.Get(block.Hash) != nil {
+			// 如果存在，不需要做任何过多的处理
+			return nil
+		}
+		// 在写事务里校验，校验和切换主链看到的是同一个tip和UTXO表，中间不会被其他区块改掉
+		if err := validateBlock(tx, block); err != nil {
+			return err
+		}
+		err := putBlock(tx, block)
+		if err != nil {
+			return err
+		}
+		// 比较新区块所在的链和当前主链的累计工作量
+		work, err := chainWork(tx, block.Hash)
+		if err != nil {
+			return err
+		}
+		tipHash := b.Get([]byte("l"))
+		tipWork, err := chainWork(tx, tipHash)
+		if err != nil {
+			return err
+		}
+		if work.Cmp(tipWork) <= 0 {
+			return nil
+		}
+		change, err = findTipChange(b, tipHash, block)
+		if err != nil {
+			return err
+		}
+		// 在同一个事务里根据撤销数据更新UTXO表，任何一步失败整个事务都会回滚
+		for _, disconnected := range change.Disconnected {
+			if err := disconnectBlock(tx, disconnected); err != nil {
+				return err
 			}
-			// 最新的区块链的Hash
-			blockHash := b.Get([]byte("l"))
-			blockBytes := b.Get(blockHash)
-			blockInDB := DeserializeBlock(blockBytes)
-			if blockInDB.Height < block.Height {
-				b.Put([]byte("l"), block.Hash)
-				bc.Tip = block.Hash
+		}
+		for _, connected := range change.Connected {
+			if err := connectBlock(tx, connected); err != nil {
+				failed = connected
+				return err
 			}
 		}
-		return nil
+		return b.Put([]byte("l"), block.Hash)
+	})
+	if failed != nil {
+		//事务已经回滚，主链和UTXO表都还停在原来的tip上
+		//把接入失败的区块和新区块记为不合法，以后收到这条链上的区块直接拒绝，不会再反复尝试切换
+		fmt.Printf("切换主链失败，区块%x不能接入: %v\n", failed.Hash, err)
+		if markErr := bc.markInvalid(failed.Hash, block.Hash); markErr != nil {
+			return nil, markErr
+		}
+		return nil, newValidationError(block.Hash, ErrInvalidChain, "区块%x不能接入: %v", failed.Hash, err)
+	}
+	if err != nil || change == nil {
+		return nil, err
+	}
+	if len(change.Disconnected) > 0 {
+		fmt.Printf("主链切换：断开%d个区块，接入%d个区块\n", len(change.Disconnected), len(change.Connected))
+	}
+	return change, nil
+}
+
+// 把最新的区块从主链上断开，tip退回到上一个区块，用于调试
+func (bc *BlockChain) RollbackTip() (*Block, error) {
+	var tipBlock *Block
+	err := bc.updateTip(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
+		tipBlock = DeserializeBlock(b.Get(b.Get([]byte("l"))))
+		if tipBlock.isGenesis() {
+			return fmt.Errorf("不能回退创世区块")
+		}
+		if err := disconnectBlock(tx, tipBlock); err != nil {
+			return err
+		}
+		return b.Put([]byte("l"), tipBlock.PrevBlockHash)
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+	return tipBlock, nil
 }
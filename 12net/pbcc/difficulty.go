@@ -0,0 +1,176 @@
+package pbcc
+
+import (
+	"fmt"
+	"math/big"
+	"publicchain/conf"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+//根据hash获取区块，既可以直接读数据库，也可以在数据库事务里读
+type blockGetter func(hash []byte) (*Block, error)
+
+//根据hash获取区块头，难度调整和时间戳检查只需要区块头
+type headerGetter func(hash []byte) (*BlockHeader, error)
+
+//在数据库事务中根据hash从区块头表获取区块头
+func txHeaderGetter(tx *bolt.Tx) headerGetter {
+	return func(hash []byte) (*BlockHeader, error) {
+		var headerBytes []byte
+		if b := tx.Bucket([]byte(conf.HeaderTableName)); b != nil {
+			headerBytes = b.Get(hash)
+		}
+		if headerBytes == nil {
+			return nil, fmt.Errorf("区块头%x不存在", hash)
+		}
+		return DecodeBlockHeader(headerBytes)
+	}
+}
+
+//在数据库事务中根据hash获取区块
+func bucketBlockGetter(b *bolt.Bucket) blockGetter {
+	return func(hash []byte) (*Block, error) {
+		blockBytes := b.Get(hash)
+		if blockBytes == nil {
+			return nil, fmt.Errorf("区块%x不存在", hash)
+		}
+		return DeserializeBlock(blockBytes), nil
+	}
+}
+
+//最低难度对应的target
+/**
+target计算方式  假设：Hash为8位，targetBit为2位
+eg:0000 0001(8位的Hash)
+1.8-2 = 6 将上值左移6位
+2.0000 0001 << 6 = 0100 0000 = target
+3.只要计算的Hash满足 ：hash < target，便是符合POW的哈希值
+*/
+func PowLimit() *big.Int {
+	target := big.NewInt(1)
+	return target.Lsh(target, 256-conf.TargetBit)
+}
+
+//最低难度的压缩格式，创世区块使用这个难度
+func PowLimitBits() uint32 {
+	return BigToCompact(PowLimit())
+}
+
+//把压缩格式的难度转为target
+//压缩格式：最高的一个字节是target的字节长度，剩下三个字节是target最高的三个字节
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if isNegative {
+		target = target.Neg(target)
+	}
+	return target
+}
+
+//把target转为压缩格式
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(target).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(target)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Uint64())
+	}
+	//最高位是符号位，被占用时多用一个字节
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	compact := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+//计算接在parent后面的区块应该使用的难度
+func (bc *BlockChain) CalcNextBits(parent *BlockHeader) (uint32, error) {
+	return calcNextBits(parent, bc.GetHeader)
+}
+
+//每隔RetargetInterval个区块，根据实际出块用的时间和期望的时间调整一次难度
+//其他高度的区块沿用上一个区块的难度
+func calcNextBits(parent *BlockHeader, getHeader headerGetter) (uint32, error) {
+	parentBits := parent.Bits
+	if parentBits == 0 {
+		//旧版本存下的区块没有Bits，使用最低难度
+		parentBits = PowLimitBits()
+	}
+	if (parent.Height+1)%conf.RetargetInterval != 0 {
+		return parentBits, nil
+	}
+	//往前找到上一个调整周期的区块
+	first := parent
+	var spans int64
+	for spans < conf.RetargetInterval && !first.isGenesis() {
+		prev, err := getHeader(first.PrevBlockHash)
+		if err != nil {
+			return 0, err
+		}
+		first = prev
+		spans++
+	}
+	if spans == 0 {
+		return parentBits, nil
+	}
+	//实际用的时间，限制在期望时间的1/4到4倍之间，避免难度变化太剧烈
+	targetTimespan := spans * conf.TargetBlockSpacing
+	actualTimespan := parent.TimeStamp - first.TimeStamp
+	if actualTimespan < targetTimespan/conf.RetargetClamp {
+		actualTimespan = targetTimespan / conf.RetargetClamp
+	}
+	if actualTimespan > targetTimespan*conf.RetargetClamp {
+		actualTimespan = targetTimespan * conf.RetargetClamp
+	}
+	//新target = 旧target * 实际时间 / 期望时间，出块太快target变小，难度变大
+	newTarget := CompactToBig(parentBits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+	if newTarget.Cmp(PowLimit()) > 0 {
+		newTarget = PowLimit()
+	}
+	return BigToCompact(newTarget), nil
+}
+
+//获取parent及之前若干个区块时间戳的中位数，新区块的时间戳不能早于它
+func medianTimePast(parent *BlockHeader, getHeader headerGetter) (int64, error) {
+	var timestamps []int64
+	header := parent
+	for i := 0; i < conf.MedianTimeBlocks; i++ {
+		timestamps = append(timestamps, header.TimeStamp)
+		if header.isGenesis() {
+			break
+		}
+		prev, err := getHeader(header.PrevBlockHash)
+		if err != nil {
+			return 0, err
+		}
+		header = prev
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2], nil
+}
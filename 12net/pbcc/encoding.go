@@ -0,0 +1,355 @@
+package pbcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"publicchain/conf"
+)
+
+/*
+	区块和交易的二进制编码，存储、计算hash和网络传输都用这一种格式，和Go语言的gob、json无关，
+	其他语言的客户端按下面的规则也能解析：
+		1.定长整数用大端字节序：uint32占4个字节，int64占8个字节
+		2.变长整数（数组长度、字节数组长度）用varint编码，和encoding/binary的Uvarint一样
+		3.字节数组先写varint长度，再写内容
+		4.结构体的字段按固定的顺序依次写入，没有字段名
+	区块和交易的开头都有一个uint32的格式版本号，以后修改格式时用来区分
+*/
+
+// 二进制编码的格式版本
+const (
+	BlockEncodingVersion uint32 = 2 //版本2增加了区块头的版本和默克尔根
+	TxEncodingVersion    uint32 = 1
+	UndoEncodingVersion  uint32 = 1
+)
+
+// 解码失败的错误类型
+var (
+	ErrUnknownEncodingVersion = errors.New("不认识的编码格式版本")
+	ErrEncodingTooLong        = errors.New("编码中的长度超过上限")
+	ErrTrailingBytes          = errors.New("编码后面有多余的数据")
+)
+
+// 二进制编码器，往缓冲区里依次写入字段
+type Encoder struct {
+	buff bytes.Buffer
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// 编码得到的字节数组
+func (e *Encoder) Bytes() []byte {
+	return e.buff.Bytes()
+}
+
+func (e *Encoder) WriteUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buff.Write(b[:])
+}
+
+func (e *Encoder) WriteInt32(v int32) {
+	e.WriteUint32(uint32(v))
+}
+
+func (e *Encoder) WriteUint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buff.Write(b[:])
+}
+
+func (e *Encoder) WriteInt64(v int64) {
+	e.WriteUint64(uint64(v))
+}
+
+func (e *Encoder) WriteVarInt(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buff.Write(b[:n])
+}
+
+func (e *Encoder) WriteVarBytes(data []byte) {
+	e.WriteVarInt(uint64(len(data)))
+	e.buff.Write(data)
+}
+
+// 二进制解码器，按写入的顺序读出字段
+// 出错以后后面的读取都不再进行，最后通过Err()检查一次就可以
+type Decoder struct {
+	reader *bytes.Reader
+	err    error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{reader: bytes.NewReader(data)}
+}
+
+// 解码过程中遇到的第一个错误
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// 还没有读取的字节数
+func (d *Decoder) Len() int {
+	return d.reader.Len()
+}
+
+func (d *Decoder) read(b []byte) {
+	if d.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(d.reader, b); err != nil {
+		d.err = err
+	}
+}
+
+func (d *Decoder) ReadUint32() uint32 {
+	var b [4]byte
+	d.read(b[:])
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func (d *Decoder) ReadInt32() int32 {
+	return int32(d.ReadUint32())
+}
+
+func (d *Decoder) ReadUint64() uint64 {
+	var b [8]byte
+	d.read(b[:])
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (d *Decoder) ReadInt64() int64 {
+	return int64(d.ReadUint64())
+}
+
+func (d *Decoder) ReadVarInt() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.reader)
+	if err != nil {
+		d.err = err
+		return 0
+	}
+	return v
+}
+
+// 读取数组长度，长度不能超过剩下的字节数，防止恶意数据让节点分配大量内存
+func (d *Decoder) ReadCount() int {
+	n := d.ReadVarInt()
+	if d.err == nil && n > uint64(d.reader.Len()) {
+		d.err = fmt.Errorf("%w: %d", ErrEncodingTooLong, n)
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *Decoder) ReadVarBytes() []byte {
+	n := d.ReadCount()
+	if d.err != nil {
+		return nil
+	}
+	data := make([]byte, n)
+	d.read(data)
+	return data
+}
+
+// 编码交易，forID为true时不包括交易ID和签名，用来计算交易ID
+func (tx *Transaction) encode(e *Encoder, forID bool) {
+	e.WriteUint32(TxEncodingVersion)
+	if !forID {
+		e.WriteVarBytes(tx.TxID)
+	}
+	e.WriteVarInt(uint64(len(tx.Vins)))
+	for _, vin := range tx.Vins {
+		e.WriteVarBytes(vin.TxID)
+		e.WriteInt32(int32(vin.Vout))
+		if !forID {
+			e.WriteVarBytes(vin.Signature)
+		}
+		e.WriteVarBytes(vin.PublicKey)
+	}
+	e.WriteVarInt(uint64(len(tx.Vouts)))
+	for _, vout := range tx.Vouts {
+		e.WriteInt64(vout.Value)
+		e.WriteVarBytes(vout.PubKeyHash)
+	}
+}
+
+// 从解码器里读出一笔交易
+func decodeTransaction(d *Decoder) *Transaction {
+	if version := d.ReadUint32(); d.Err() == nil && version != TxEncodingVersion {
+		d.err = fmt.Errorf("%w: 交易格式版本%d", ErrUnknownEncodingVersion, version)
+	}
+	tx := &Transaction{TxID: d.ReadVarBytes()}
+	for i, n := 0, d.ReadCount(); i < n && d.Err() == nil; i++ {
+		vin := &TXInput{}
+		vin.TxID = d.ReadVarBytes()
+		vin.Vout = int(d.ReadInt32())
+		vin.Signature = d.ReadVarBytes()
+		vin.PublicKey = d.ReadVarBytes()
+		tx.Vins = append(tx.Vins, vin)
+	}
+	for i, n := 0, d.ReadCount(); i < n && d.Err() == nil; i++ {
+		vout := &TXOuput{}
+		vout.Value = d.ReadInt64()
+		vout.PubKeyHash = d.ReadVarBytes()
+		tx.Vouts = append(tx.Vouts, vout)
+	}
+	return tx
+}
+
+// 解码一笔交易，数据来自其他节点时用这个函数，不合法的数据返回错误而不是panic
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	d := NewDecoder(data)
+	tx := decodeTransaction(d)
+	if d.Err() == nil && d.Len() > 0 {
+		return nil, ErrTrailingBytes
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	return tx, nil
+}
+
+// 编码一个UTXO，撤销数据里用，bool用varint的0和1表示
+func (utxo *UTXO) encode(e *Encoder) {
+	e.WriteVarBytes(utxo.TxID)
+	e.WriteInt32(int32(utxo.Index))
+	e.WriteInt64(utxo.Output.Value)
+	e.WriteVarBytes(utxo.Output.PubKeyHash)
+	e.WriteInt64(utxo.Height)
+	if utxo.Coinbase {
+		e.WriteVarInt(1)
+	} else {
+		e.WriteVarInt(0)
+	}
+}
+
+// 从解码器里读出一个UTXO
+func decodeUTXO(d *Decoder) *UTXO {
+	utxo := &UTXO{Output: &TXOuput{}}
+	utxo.TxID = d.ReadVarBytes()
+	utxo.Index = int(d.ReadInt32())
+	utxo.Output.Value = d.ReadInt64()
+	utxo.Output.PubKeyHash = d.ReadVarBytes()
+	utxo.Height = d.ReadInt64()
+	utxo.Coinbase = d.ReadVarInt() == 1
+	return utxo
+}
+
+// 编码区块头，Nonce放在最后
+func (header *BlockHeader) encode(e *Encoder) {
+	e.WriteUint32(header.Version)
+	e.WriteInt64(header.Height)
+	e.WriteVarBytes(header.PrevBlockHash)
+	e.WriteVarBytes(header.MerkleRoot)
+	e.WriteInt64(header.TimeStamp)
+	e.WriteUint32(header.Bits)
+	e.WriteInt64(header.Nonce)
+}
+
+// 从解码器里读出区块头
+func decodeBlockHeader(d *Decoder) *BlockHeader {
+	header := &BlockHeader{}
+	header.Version = d.ReadUint32()
+	header.Height = d.ReadInt64()
+	header.PrevBlockHash = d.ReadVarBytes()
+	header.MerkleRoot = d.ReadVarBytes()
+	header.TimeStamp = d.ReadInt64()
+	header.Bits = d.ReadUint32()
+	header.Nonce = d.ReadInt64()
+	return header
+}
+
+// 把区块头序列化成字节数组
+func (header *BlockHeader) Serialize() []byte {
+	e := NewEncoder()
+	header.encode(e)
+	return e.Bytes()
+}
+
+// 解码一个区块头，数据来自其他节点时不合法的数据返回错误而不是panic
+func DecodeBlockHeader(data []byte) (*BlockHeader, error) {
+	d := NewDecoder(data)
+	header := decodeBlockHeader(d)
+	if d.Err() == nil && d.Len() > 0 {
+		return nil, ErrTrailingBytes
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	return header, nil
+}
+
+// 编码区块：区块头、区块hash、交易
+// 区块hash可以由区块头算出来，但是旧格式数据库升级上来的区块hash是按旧的规则算的，所以要存下来
+func (block *Block) encode(e *Encoder) {
+	e.WriteUint32(BlockEncodingVersion)
+	block.BlockHeader.encode(e)
+	e.WriteVarBytes(block.Hash)
+	e.WriteVarInt(uint64(len(block.Txs)))
+	for _, tx := range block.Txs {
+		tx.encode(e, false)
+	}
+}
+
+// 解码格式版本1的区块：还没有区块头版本和默克尔根
+func decodeBlockV1(d *Decoder) *Block {
+	block := &Block{}
+	block.Height = d.ReadInt64()
+	block.PrevBlockHash = d.ReadVarBytes()
+	block.TimeStamp = d.ReadInt64()
+	block.Bits = d.ReadUint32()
+	block.Nonce = d.ReadInt64()
+	block.Hash = d.ReadVarBytes()
+	return block
+}
+
+// 解码一个区块，数据来自其他节点时用这个函数，不合法的数据返回错误而不是panic
+func DecodeBlock(data []byte) (*Block, error) {
+	if len(data) > conf.MaxBlockSize {
+		return nil, fmt.Errorf("%w: 区块有%d个字节", ErrEncodingTooLong, len(data))
+	}
+	d := NewDecoder(data)
+	version := d.ReadUint32()
+	var block *Block
+	switch {
+	case d.Err() != nil:
+		return nil, d.Err()
+	case version == 1:
+		block = decodeBlockV1(d)
+	case version == BlockEncodingVersion:
+		block = &Block{BlockHeader: *decodeBlockHeader(d)}
+		block.Hash = d.ReadVarBytes()
+	default:
+		return nil, fmt.Errorf("%w: 区块格式版本%d", ErrUnknownEncodingVersion, version)
+	}
+	for i, n := 0, d.ReadCount(); i < n && d.Err() == nil; i++ {
+		block.Txs = append(block.Txs, decodeTransaction(d))
+	}
+	if d.Err() == nil && d.Len() > 0 {
+		return nil, ErrTrailingBytes
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	if version == 1 {
+		block.MerkleRoot = block.HashTransactions()
+	}
+	return block, nil
+}
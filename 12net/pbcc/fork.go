@@ -0,0 +1,102 @@
+package pbcc
+
+import (
+	"bytes"
+	"math/big"
+	"publicchain/conf"
+
+	"github.com/boltdb/bolt"
+)
+
+// 主链的tip发生变化的结果，交易池根据它更新
+type TipChange struct {
+	Disconnected []*Block // 从主链上断开的区块，从原来的tip往前排
+	Connected    []*Block // 新接到主链上的区块，按高度从低到高排
+}
+
+// 计算一个区块的工作量：2^256 / (target+1)，难度越大，工作量越大
+// 只需要区块头里的难度目标
+func CalcBlockWork(header *BlockHeader) *big.Int {
+	target := bitsToTarget(header.Bits)
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	return numerator.Div(numerator, denominator)
+}
+
+// 获取从创世区块到指定区块累计的工作量
+func (bc *BlockChain) GetChainWork(blockHash []byte) (*big.Int, error) {
+	var work *big.Int
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		work, err = chainWork(tx, blockHash)
+		return err
+	})
+	return work, err
+}
+
+// 在数据库事务中获取累计工作量，只需要读区块头
+// 没有记录过的区块(比如旧版本存下的区块)，往前找到有记录的区块后依次计算并存下来
+func chainWork(tx *bolt.Tx, blockHash []byte) (*big.Int, error) {
+	getHeader := txHeaderGetter(tx)
+	works, err := tx.CreateBucketIfNotExists([]byte(conf.ChainWorkTableName))
+	if err != nil {
+		return nil, err
+	}
+	work := new(big.Int)
+	var path []*BlockHeader
+	var hashes [][]byte
+	hash := blockHash
+	for {
+		if workBytes := works.Get(hash); workBytes != nil {
+			work.SetBytes(workBytes)
+			break
+		}
+		header, err := getHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, header)
+		hashes = append(hashes, hash)
+		if header.isGenesis() {
+			break
+		}
+		hash = header.PrevBlockHash
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		work.Add(work, CalcBlockWork(path[i]))
+		err := works.Put(hashes[i], work.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return work, nil
+}
+
+// 找出从原来的tip切换到新tip时，要断开和接入的区块
+func findTipChange(b *bolt.Bucket, oldTipHash []byte, newTip *Block) (*TipChange, error) {
+	getBlock := bucketBlockGetter(b)
+	oldBlock, err := getBlock(oldTipHash)
+	if err != nil {
+		return nil, err
+	}
+	newBlock := newTip
+	change := &TipChange{}
+	var connected []*Block
+	//两边一起往前走，直到找到共同的祖先区块
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		if oldBlock.Height >= newBlock.Height {
+			change.Disconnected = append(change.Disconnected, oldBlock)
+			oldBlock, err = getBlock(oldBlock.PrevBlockHash)
+		} else {
+			connected = append(connected, newBlock)
+			newBlock, err = getBlock(newBlock.PrevBlockHash)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := len(connected) - 1; i >= 0; i-- {
+		change.Connected = append(change.Connected, connected[i])
+	}
+	return change, nil
+}
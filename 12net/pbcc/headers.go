@@ -0,0 +1,131 @@
+package pbcc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"publicchain/conf"
+
+	"github.com/boltdb/bolt"
+)
+
+// 区块头的hash，和挖矿时计算的hash一样
+func (header *BlockHeader) BlockHash() []byte {
+	hash := sha256.Sum256(header.Serialize())
+	return hash[:]
+}
+
+// 判断区块是否已经下载并存储，只有区块头不算
+func (bc *BlockChain) HasBlock(blockHash []byte) bool {
+	blockBytes, err := bc.GetBlock(blockHash)
+	return err == nil && blockBytes != nil
+}
+
+// 判断区块头是否已经存储
+func (bc *BlockChain) HasHeader(blockHash []byte) bool {
+	_, err := bc.GetHeader(blockHash)
+	return err == nil
+}
+
+// 校验并存储一个区块头，还没有下载区块时先存区块头，区块下载完成后再接入主链
+// 已经存过的区块头直接返回，返回区块头的hash
+func (bc *BlockChain) AddHeader(header *BlockHeader) ([]byte, error) {
+	hash := header.BlockHash()
+	if bc.HasHeader(hash) {
+		return hash, nil
+	}
+	if err := bc.ValidateHeader(header, hash); err != nil {
+		return nil, err
+	}
+	err := bc.DB.Update(func(tx *bolt.Tx) error {
+		headers, err := tx.CreateBucketIfNotExists([]byte(conf.HeaderTableName))
+		if err != nil {
+			return err
+		}
+		return headers.Put(hash, header.Serialize())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// 生成区块定位器：从指定的区块往前，最近的10个区块逐个列出，再往前间隔每次翻倍，最后是创世区块
+// 对方根据定位器里第一个在它主链上的区块，就能找到两条链分叉的位置
+func (bc *BlockChain) BlockLocator(blockHash []byte) [][]byte {
+	var locator [][]byte
+	step := int64(1)
+	header, err := bc.GetHeader(blockHash)
+	if err != nil {
+		return locator
+	}
+	hash := blockHash
+	for {
+		locator = append(locator, hash)
+		if header.isGenesis() {
+			break
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		//往前走step个区块，不够就停在创世区块
+		for i := int64(0); i < step && !header.isGenesis(); i++ {
+			hash = header.PrevBlockHash
+			header, err = bc.GetHeader(hash)
+			if err != nil {
+				return locator
+			}
+		}
+	}
+	return locator
+}
+
+// 根据对方发来的定位器，找出主链上接在分叉点后面的区块头，最多max个，遇到stopHash停止
+// 定位器里的区块都不在主链上时，从创世区块后面开始
+func (bc *BlockChain) LocateHeaders(locator [][]byte, stopHash []byte, max int) []*BlockHeader {
+	tip, err := bc.GetHeader(bc.GetTipHash())
+	if err != nil || max <= 0 {
+		return nil
+	}
+	//区块头里有高度，主链上这个高度的区块就是它，说明它在主链上，定位器从新到旧排列，第一个在主链上的就是分叉点
+	start := int64(1)
+	for _, hash := range locator {
+		header, err := bc.GetHeader(hash)
+		if err != nil {
+			continue
+		}
+		if mainHash, err := bc.GetBlockHashByHeight(header.Height); err == nil && bytes.Equal(mainHash, hash) {
+			start = header.Height + 1
+			break
+		}
+	}
+	end := start + int64(max) - 1
+	if end > tip.Height {
+		end = tip.Height
+	}
+	if start > end {
+		return nil
+	}
+	//从最后一个要回复的区块往前走到分叉点，不用遍历整条主链
+	hash, err := bc.GetBlockHashByHeight(end)
+	if err != nil {
+		return nil
+	}
+	headers := make([]*BlockHeader, end-start+1)
+	hashes := make([][]byte, len(headers))
+	for i := len(headers) - 1; i >= 0; i-- {
+		header, err := bc.GetHeader(hash)
+		if err != nil {
+			return nil
+		}
+		headers[i], hashes[i] = header, hash
+		hash = header.PrevBlockHash
+	}
+	if len(stopHash) > 0 {
+		for i, hash := range hashes {
+			if bytes.Equal(hash, stopHash) {
+				return headers[:i+1]
+			}
+		}
+	}
+	return headers
+}
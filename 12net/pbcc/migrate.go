@@ -0,0 +1,228 @@
+package pbcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"publicchain/conf"
+
+	"github.com/boltdb/bolt"
+)
+
+//数据库格式版本存在meta表里的key
+const schemaVersionKey = "schemaVersion"
+
+//升级上来的旧区块的最大高度存在meta表里的key
+const legacyHeightKey = "legacyHeight"
+
+//读取数据库格式版本，没有meta表的是最早用gob存区块的数据库，版本为1
+func dbSchemaVersion(tx *bolt.Tx) int {
+	b := tx.Bucket([]byte(conf.MetaTableName))
+	if b == nil {
+		return 1
+	}
+	versionBytes := b.Get([]byte(schemaVersionKey))
+	if len(versionBytes) != 4 {
+		return 1
+	}
+	return int(binary.BigEndian.Uint32(versionBytes))
+}
+
+//旧格式数据库升级上来的区块里最大的高度，没有这样的区块时返回-1
+//这些区块的hash是按旧格式算的，其他节点不能校验，也不能再按现在的规则校验
+func legacyHeight(tx *bolt.Tx) int64 {
+	b := tx.Bucket([]byte(conf.MetaTableName))
+	if b == nil {
+		return -1
+	}
+	heightBytes := b.Get([]byte(legacyHeightKey))
+	if len(heightBytes) != 8 {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(heightBytes))
+}
+
+//记录升级上来的旧区块的最大高度
+func setLegacyHeight(tx *bolt.Tx, height int64) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(conf.MetaTableName))
+	if err != nil {
+		return err
+	}
+	var heightBytes [8]byte
+	binary.BigEndian.PutUint64(heightBytes[:], uint64(height))
+	return b.Put([]byte(legacyHeightKey), heightBytes[:])
+}
+
+//区块链里是否有旧格式数据库升级上来的区块，有的话不能把区块提供给其他节点
+func (bc *BlockChain) IsLegacyChain() bool {
+	legacy := false
+	bc.DB.View(func(tx *bolt.Tx) error {
+		legacy = legacyHeight(tx) >= 0
+		return nil
+	})
+	return legacy
+}
+
+//把数据库格式版本写成当前版本
+func setDBSchemaVersion(tx *bolt.Tx) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(conf.MetaTableName))
+	if err != nil {
+		return err
+	}
+	var versionBytes [4]byte
+	binary.BigEndian.PutUint32(versionBytes[:], conf.DBSchemaVersion)
+	return b.Put([]byte(schemaVersionKey), versionBytes[:])
+}
+
+//版本1数据库里用gob存的区块，字段名不能修改，否则gob解码不出来
+type gobBlock struct {
+	Height        int64
+	PrevBlockHash []byte
+	Txs           []*Transaction
+	TimeStamp     int64
+	Bits          uint32
+	Hash          []byte
+	Nonce         int64
+}
+
+//用gob解码版本1数据库里的区块
+func deserializeGobBlock(blockBytes []byte) (*Block, error) {
+	var old gobBlock
+	decoder := gob.NewDecoder(bytes.NewReader(blockBytes))
+	if err := decoder.Decode(&old); err != nil {
+		return nil, err
+	}
+	block := &Block{BlockHeader{0, old.Height, old.PrevBlockHash, nil, old.TimeStamp, old.Bits, old.Nonce}, old.Txs, old.Hash}
+	block.MerkleRoot = block.HashTransactions()
+	return block, nil
+}
+
+//版本4以前的数据库里用gob存的撤销数据，BlockUndo和UTXO的字段名不能修改
+func deserializeGobBlockUndo(undoBytes []byte) (*BlockUndo, error) {
+	var undo BlockUndo
+	decoder := gob.NewDecoder(bytes.NewReader(undoBytes))
+	if err := decoder.Decode(&undo); err != nil {
+		return nil, err
+	}
+	return &undo, nil
+}
+
+//把撤销数据从gob编码转换成二进制编码
+func migrateUndo(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket([]byte(conf.UndoTableName))
+	if b == nil {
+		return 0, nil
+	}
+	undos := make(map[string]*BlockUndo)
+	err := b.ForEach(func(k, v []byte) error {
+		if bytes.Equal(k, []byte("l")) {
+			return nil
+		}
+		undo, err := deserializeGobBlockUndo(v)
+		if err != nil {
+			return fmt.Errorf("区块%x的撤销数据解码失败: %v", k, err)
+		}
+		undos[string(k)] = undo
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for hash, undo := range undos {
+		if err := b.Put([]byte(hash), undo.Serialize()); err != nil {
+			return 0, err
+		}
+	}
+	return len(undos), nil
+}
+
+//把旧格式的数据库升级到当前格式：区块按当前的二进制编码重新存一遍，同时建立区块头表，撤销数据改成二进制编码
+//版本1的区块是gob编码，版本2的区块是还没有区块头版本和默克尔根的二进制编码
+//区块hash和交易ID保持不变，UTXO表和撤销数据里的交易ID也就都不用改
+//注意：旧区块的hash是按旧格式算出来的，其他节点不能重新校验这些区块，所以记下旧区块的最大高度，
+//节点启动后不再向其他节点提供区块，只能自己使用这些数据
+//旧区块按固定奖励发行，也没有coinbase成熟期，不会再按现在的规则重新校验，新挖出的区块才按现在的规则校验
+func MigrateDB(nodeID string) error {
+	DBNAME := fmt.Sprintf(conf.DBNAME, nodeID)
+	if !dbExists(DBNAME) {
+		return fmt.Errorf("数据库%s不存在", DBNAME)
+	}
+	db, err := bolt.Open(DBNAME, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		version := dbSchemaVersion(tx)
+		if version == conf.DBSchemaVersion {
+			fmt.Printf("数据库已经是最新的格式版本%d\n", version)
+			return nil
+		}
+		if version > conf.DBSchemaVersion {
+			return fmt.Errorf("数据库格式版本%d比程序支持的版本%d新", version, conf.DBSchemaVersion)
+		}
+		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
+		if b == nil {
+			return fmt.Errorf("数据库中没有区块表")
+		}
+		//遍历的时候不能修改表，先把区块都解码出来
+		var blocks []*Block
+		err := b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, []byte("l")) {
+				return nil
+			}
+			var block *Block
+			var err error
+			if version == 1 {
+				block, err = deserializeGobBlock(v)
+			} else {
+				block, err = DecodeBlock(v)
+			}
+			if err != nil {
+				return fmt.Errorf("区块%x解码失败: %v", k, err)
+			}
+			blocks = append(blocks, block)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		//之前升级过的数据库也要检查，hash和区块内容对不上的就是旧区块
+		oldHeight := legacyHeight(tx)
+		for _, block := range blocks {
+			if err := putBlock(tx, block); err != nil {
+				return err
+			}
+			if !bytes.Equal(NewProofOfWork(block).CalculateHash(), block.Hash) && block.Height > oldHeight {
+				oldHeight = block.Height
+			}
+		}
+		if oldHeight >= 0 {
+			if err := setLegacyHeight(tx, oldHeight); err != nil {
+				return err
+			}
+			fmt.Printf("高度%d以下有旧格式的区块，其他节点不能校验，节点不会再向其他节点提供区块\n", oldHeight)
+		}
+		undoCount, err := migrateUndo(tx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("数据库从格式版本%d升级到%d，转换了%d个区块和%d个区块的撤销数据\n", version, conf.DBSchemaVersion, len(blocks), undoCount)
+		return setDBSchemaVersion(tx)
+	})
+}
+
+//打开数据库时检查格式版本，旧格式的数据库需要先升级
+func checkDBSchemaVersion(db *bolt.DB) {
+	err := db.View(func(tx *bolt.Tx) error {
+		if version := dbSchemaVersion(tx); version != conf.DBSchemaVersion {
+			return fmt.Errorf("数据库格式版本是%d，程序需要的版本是%d，请先运行 migratedb 升级数据库", version, conf.DBSchemaVersion)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package pbcc
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//挖矿进度
+type MiningStats struct {
+	Hashes   uint64        //已经计算的hash次数
+	Elapsed  time.Duration //已经用的时间
+	HashRate float64       //每秒计算的hash次数
+}
+
+//挖矿参数
+type MiningOptions struct {
+	Workers          int                     //并行计算的goroutine数量，不设置时使用CPU核数
+	Progress         func(stats MiningStats) //定期回调挖矿进度，可以为nil
+	ProgressInterval time.Duration           //回调进度的间隔，不设置时为1秒
+	Now              func() time.Time        //区块时间戳使用的时钟，不设置时使用time.Now
+}
+
+//每个worker计算多少次hash检查一次是否被取消
+const miningCheckInterval = 1024
+
+//一轮挖矿的结果
+type miningResult struct {
+	hash  []byte
+	nonce int64
+}
+
+//多个goroutine并行挖矿，ctx被取消时停止并返回ctx的错误
+//nonce被分给各个worker：第i个worker计算i, i+n, i+2n...
+//整个int64范围都算完还没找到时，时间戳加1后重新开始
+func (pow *ProofOfWork) Mine(ctx context.Context, opts MiningOptions) ([]byte, int64, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var hashes uint64
+	start := time.Now()
+
+	//定期汇报进度
+	if opts.Progress != nil {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					opts.Progress(newMiningStats(atomic.LoadUint64(&hashes), time.Since(start)))
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		result, err := pow.mineRound(ctx, workers, &hashes)
+		if err != nil {
+			return nil, 0, err
+		}
+		if result != nil {
+			if opts.Progress != nil {
+				opts.Progress(newMiningStats(atomic.LoadUint64(&hashes), time.Since(start)))
+			}
+			return result.hash, result.nonce, nil
+		}
+		//nonce用完了，换一个时间戳继续
+		pow.Block.TimeStamp++
+	}
+}
+
+//计算挖矿进度
+func newMiningStats(hashes uint64, elapsed time.Duration) MiningStats {
+	stats := MiningStats{Hashes: hashes, Elapsed: elapsed}
+	if elapsed > 0 {
+		stats.HashRate = float64(hashes) / elapsed.Seconds()
+	}
+	return stats
+}
+
+//在当前时间戳下把整个nonce范围分给workers计算，找到时返回结果，nonce用完时返回nil
+func (pow *ProofOfWork) mineRound(ctx context.Context, workers int, hashes *uint64) (*miningResult, error) {
+	roundCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan *miningResult, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first int64) {
+			defer wg.Done()
+			var count uint64
+			for nonce := first; ; nonce += int64(workers) {
+				count++
+				if count%miningCheckInterval == 0 {
+					atomic.AddUint64(hashes, miningCheckInterval)
+					if roundCtx.Err() != nil {
+						return
+					}
+				}
+				hash, ok := pow.tryNonce(nonce)
+				if ok {
+					select {
+					case results <- &miningResult{hash, nonce}:
+					default:
+					}
+					cancel()
+					return
+				}
+				if nonce > math.MaxInt64-int64(workers) {
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	select {
+	case result := <-results:
+		return result, nil
+	default:
+	}
+	//外部取消
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+//用指定的nonce计算hash，判断是否满足难度要求
+func (pow *ProofOfWork) tryNonce(nonce int64) ([]byte, bool) {
+	hash := sha256Sum(pow.prepareData(nonce))
+	return hash, pow.checkHash(hash)
+}
+
+//挖出一个新的区块，ctx被取消时返回错误
+//只用一个worker并且设置了Now时，同样的交易和上一个区块挖出来的区块总是相同的
+func MineBlock(ctx context.Context, txs []*Transaction, provBlockHash []byte, height int64, bits uint32, opts MiningOptions) (*Block, error) {
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	block := newBlockTemplate(txs, provBlockHash, height, bits, now().Unix())
+	pow := NewProofOfWork(block)
+	hash, nonce, err := pow.Mine(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	block.Hash = hash
+	block.Nonce = nonce
+	return block, nil
+}
@@ -2,11 +2,10 @@ package pbcc
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"fmt"
+	"log"
 	"math/big"
-	"publicchain/conf"
-	"publicchain/utils"
 )
 
 //pow结构体
@@ -19,74 +18,70 @@ type ProofOfWork struct {
 
 //创建新的工作量证明对象
 func NewProofOfWork(block *Block) *ProofOfWork {
-	/**
-	target计算方式  假设：Hash为8位，targetBit为2位
-	eg:0000 0001(8位的Hash)
-	1.8-2 = 6 将上值左移6位
-	2.0000 0001 << 6 = 0100 0000 = target
-	3.只要计算的Hash满足 ：hash < target，便是符合POW的哈希值
-	*/
+	//根据区块里的难度目标得到target
+	return &ProofOfWork{block, bitsToTarget(block.Bits)}
+}
 
-	//创建一个初始值为1的target
-	target := big.NewInt(1)
-	//2.左移256-bits位
-	target = target.Lsh(target, 256-conf.TargetBit)
-	return &ProofOfWork{block, target}
+//把区块头里的难度目标转为target
+func bitsToTarget(bits uint32) *big.Int {
+	if bits == 0 {
+		//旧版本存下的区块没有Bits，使用最低难度
+		return PowLimit()
+	}
+	return CompactToBig(bits)
 }
 
-//根据block生成一个byte数组
-func (pow *ProofOfWork) prepareData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevBlockHash,
-			pow.Block.HashTransactions(),
-			utils.IntToHex(pow.Block.Height),
-			utils.IntToHex(int64(pow.Block.TimeStamp)),
-			utils.IntToHex(int64(nonce)),
-		},
-		[]byte{},
-	)
-	return data
+//根据区块头生成一个byte数组，只换nonce，交易的默克尔根已经存在区块头里，不用每次重新计算
+func (pow *ProofOfWork) prepareData(nonce int64) []byte {
+	header := pow.Block.BlockHeader
+	header.Nonce = nonce
+	return header.Serialize()
 }
 
 //挖矿
-//返回有效的哈希和nonce值
+//返回有效的哈希和nonce值，使用所有CPU核并行计算，不能取消
+//需要取消或者获取进度时使用Mine
 func (pow *ProofOfWork) Run() ([]byte, int64) {
-	//1.将Block的属性拼接成字节数组
-	//2.生成Hash
-	//3.循环判断Hash的有效性，满足条件，跳出循环结束验证
-	nonce := 0
-	//用于存储新生成的hash
-	hashInt := new(big.Int)
-	var hash [32]byte
-	for {
-		//获取字节数组
-		dataBytes := pow.prepareData(nonce)
-		//生成hash
-		hash = sha256.Sum256(dataBytes)
-		// 不断的计算
-		fmt.Printf("\r%d: %x", nonce, hash)
-		//将hash存储到hashInt
-		hashInt.SetBytes(hash[:])
-		/*
-			判断hashInt是否小于Block里的target
-			Com compares x and y and returns:
-			-1 if x < y
-			0 if x == y
-			1 if x > y
-		*/
-		if pow.Target.Cmp(hashInt) == 1 {
-			break
-		}
-		nonce++
+	hash, nonce, err := pow.Mine(context.Background(), MiningOptions{})
+	if err != nil {
+		log.Panic(err)
 	}
-	fmt.Println()
-	return hash[:], int64(nonce)
+	return hash, nonce
 }
 
-// 判断算出来的hash值是否有效
-func (pow *ProofOfWork) IsValid() bool {
+//计算sha256
+func sha256Sum(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+//判断hash是否小于target
+func (pow *ProofOfWork) checkHash(hash []byte) bool {
 	hashInt := new(big.Int)
-	hashInt.SetBytes(pow.Block.Hash)
+	hashInt.SetBytes(hash)
+	/*
+		Com compares x and y and returns:
+		-1 if x < y
+		0 if x == y
+		1 if x > y
+	*/
 	return pow.Target.Cmp(hashInt) == 1
 }
+
+// 根据区块内容和Nonce重新计算hash
+func (pow *ProofOfWork) CalculateHash() []byte {
+	return sha256Sum(pow.prepareData(pow.Block.Nonce))
+}
+
+// 判断区块的hash值是否有效：重新计算hash，而不是直接相信Block.Hash
+func (pow *ProofOfWork) IsValid() bool {
+	//target必须是正数，并且不能低于最低难度
+	if pow.Target.Sign() <= 0 || pow.Target.Cmp(PowLimit()) > 0 {
+		return false
+	}
+	hash := pow.CalculateHash()
+	if !bytes.Equal(hash, pow.Block.Hash) {
+		return false
+	}
+	return pow.checkHash(hash)
+}
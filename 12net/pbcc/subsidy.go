@@ -0,0 +1,36 @@
+package pbcc
+
+import "publicchain/conf"
+
+//高度为height的区块的coinbase最多能领取的区块奖励，不包括手续费
+//每隔SubsidyHalvingInterval个区块减半，减到0以后矿工只能领取手续费
+func CalcBlockSubsidy(height int64) int64 {
+	if height < 0 {
+		return 0
+	}
+	halvings := height / conf.SubsidyHalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return conf.InitialBlockSubsidy >> uint(halvings)
+}
+
+//按发行计划最终发行的总量：每个减半周期的区块奖励乘以周期的长度，加起来
+//由InitialBlockSubsidy和SubsidyHalvingInterval决定，不单独配置，免得两边对不上
+var maxMoneySupply = calcMaxMoneySupply()
+
+func calcMaxMoneySupply() int64 {
+	var total int64
+	for height := int64(0); ; height += conf.SubsidyHalvingInterval {
+		subsidy := CalcBlockSubsidy(height)
+		if subsidy == 0 {
+			return total
+		}
+		total += subsidy * conf.SubsidyHalvingInterval
+	}
+}
+
+//发行总量上限，任何金额都不可能超过它
+func MaxMoneySupply() int64 {
+	return maxMoneySupply
+}
@@ -6,14 +6,11 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
-	"encoding/json"
 	"log"
 	"math/big"
 	"publicchain/utils"
 	"publicchain/wallet"
-	"time"
 )
 
 //Transaction结构体
@@ -23,10 +20,11 @@ type Transaction struct {
 	Vouts []*TXOuput //输出
 }
 
-// 铸币交易
-func NewCoinBaseTransaction(address string) *Transaction {
-	txInput := &TXInput{[]byte{}, -1, nil, []byte{}}
-	txOutput := NewTXOuput(10, address)
+// 铸币交易，矿工领取高度为height的区块的奖励和区块里所有交易的手续费
+// coinbase的输入不引用任何输出，在PublicKey里放区块高度，这样不同区块的coinbase交易ID不会重复
+func NewCoinBaseTransaction(address string, height int64, fees int64) *Transaction {
+	txInput := &TXInput{[]byte{}, -1, nil, utils.IntToHex(height)}
+	txOutput := NewTXOuput(CalcBlockSubsidy(height)+fees, address)
 	txCoinbase := &Transaction{[]byte{}, []*TXInput{txInput}, []*TXOuput{txOutput}}
 	txCoinbase.SetTxID()
 	return txCoinbase
@@ -34,27 +32,38 @@ func NewCoinBaseTransaction(address string) *Transaction {
 
 //设置交易的hash
 func (tx *Transaction) SetTxID() {
-	var buff bytes.Buffer
-	encoder := gob.NewEncoder(&buff)
-	err := encoder.Encode(tx)
-	if err != nil {
-		log.Panic(err)
+	tx.TxID = tx.Hash()
+}
+
+//根据交易内容计算交易ID，不包括签名，也不依赖当前时间
+//同一笔交易在任何节点上算出来的ID都一样，收到交易时可以重新计算来校验TxID
+//签名要对交易ID以外的内容签名，所以签名不能参与计算交易ID
+func (tx *Transaction) Hash() []byte {
+	e := NewEncoder()
+	tx.encode(e, true)
+	hash := sha256.Sum256(e.Bytes())
+	return hash[:]
+}
+
+// 交易所有输出的总额
+func (tx *Transaction) OutputValue() int64 {
+	var value int64
+	for _, out := range tx.Vouts {
+		value += out.Value
 	}
-	buffBytes := bytes.Join([][]byte{utils.IntToHex(time.Now().Unix()), buff.Bytes()}, []byte{})
-	hash := sha256.Sum256(buffBytes)
-	tx.TxID = hash[:]
+	return value
 }
 
-//判断当前交易是否是Coinbase交易
+// 判断当前交易是否是Coinbase交易
 func (tx *Transaction) IsCoinbaseTransaction() bool {
 	return len(tx.Vins[0].TxID) == 0 && tx.Vins[0].Vout == -1
 }
 
-// 创建普通交易
-func NewSimpleTransaction(from, to string, amount int64, utxoSet *UTXOSet, txs []*Transaction, nodeID string) *Transaction {
+// 创建普通交易，输入总额减去输出总额就是支付给矿工的手续费fee
+func NewSimpleTransaction(from, to string, amount int64, fee int64, utxoSet *UTXOSet, txs []*Transaction, nodeID string) *Transaction {
 	var txInputs []*TXInput
 	var txOutputs []*TXOuput
-	balance, spendableUTXO := utxoSet.FindSpendableUTXOs(from, amount, txs)
+	balance, spendableUTXO := utxoSet.FindSpendableUTXOs(from, amount+fee, txs)
 
 	//获取钱包
 	wallets := wallet.NewWallets(nodeID)
@@ -72,9 +81,11 @@ func NewSimpleTransaction(from, to string, amount int64, utxoSet *UTXOSet, txs [
 	txOutput1 := NewTXOuput(amount, to)
 	txOutputs = append(txOutputs, txOutput1)
 
-	//找零
-	txOutput2 := NewTXOuput(balance-amount, from)
-	txOutputs = append(txOutputs, txOutput2)
+	//找零，扣掉手续费以后剩下的钱
+	if change := balance - amount - fee; change > 0 {
+		txOutput2 := NewTXOuput(change, from)
+		txOutputs = append(txOutputs, txOutput2)
+	}
 
 	tx := &Transaction{[]byte{}, txInputs, txOutputs}
 	//设置hash值
@@ -147,13 +158,11 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	return txCopy
 }
 
-//把交易序列化成字节数组
+//把交易序列化成字节数组，格式见encoding.go
 func (tx *Transaction) Serialize() []byte {
-	jsonByte, err := json.Marshal(tx)
-	if err != nil {
-		log.Panic(err)
-	}
-	return jsonByte
+	e := NewEncoder()
+	tx.encode(e, false)
+	return e.Bytes()
 }
 
 // 获取交易的hash
@@ -170,18 +179,39 @@ func (tx *Transaction) Verify(prevTXs map[string]*Transaction) bool {
 		return true
 	}
 	//没有对应的transaction,无法签名
+	var spent []*TXOuput
 	for _, vin := range tx.Vins {
-		if prevTXs[hex.EncodeToString(vin.TxID)].TxID == nil {
+		prevTx := prevTXs[hex.EncodeToString(vin.TxID)]
+		if prevTx.TxID == nil {
 			log.Panic("当前的input没有对应的transaction,无法验证")
 		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vouts) {
+			return false
+		}
+		spent = append(spent, prevTx.Vouts[vin.Vout])
+	}
+	return tx.VerifySignatures(spent)
+}
+
+//用输入引用的输出验证数字签名，spent[i]是第i个输入引用的输出，由调用者从UTXO表、交易池或者区块里找到
+//不读取区块链，输入的公钥必须和引用的输出的公钥哈希一致
+func (tx *Transaction) VerifySignatures(spent []*TXOuput) bool {
+	if tx.IsCoinbaseTransaction() {
+		return true
+	}
+	if len(spent) != len(tx.Vins) {
+		return false
 	}
 	txCopy := tx.TrimmedCopy()
 
 	curve := elliptic.P256()
 	for index, input := range tx.Vins {
-		prevTx := prevTXs[hex.EncodeToString(input.TxID)]
+		prevOut := spent[index]
+		if prevOut == nil || !bytes.Equal(wallet.PubKeyHash(input.PublicKey), prevOut.PubKeyHash) {
+			return false
+		}
 		txCopy.Vins[index].Signature = nil
-		txCopy.Vins[index].PublicKey = prevTx.Vouts[input.Vout].PubKeyHash
+		txCopy.Vins[index].PublicKey = prevOut.PubKeyHash
 		data := txCopy.getData()
 		txCopy.Vins[index].PublicKey = nil
 
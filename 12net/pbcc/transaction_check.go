@@ -0,0 +1,111 @@
+package pbcc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// 交易校验失败的错误类型，交易池和区块校验共用
+var (
+	ErrTxBadID             = errors.New("交易ID与交易内容不符")
+	ErrTxNoInputs          = errors.New("交易没有输入")
+	ErrTxNoOutputs         = errors.New("交易没有输出")
+	ErrTxBadInput          = errors.New("交易输入不合法")
+	ErrTxDuplicateInput    = errors.New("交易重复引用了同一个输出")
+	ErrTxNegativeValue     = errors.New("交易金额为负数")
+	ErrTxValueOverflow     = errors.New("交易金额超过发行总量上限")
+	ErrTxInsufficientInput = errors.New("交易的输出总额大于输入总额")
+)
+
+//金额必须在0到发行计划的总量之间，金额累加前都要检查，保证int64不会溢出
+func checkValue(value int64) error {
+	if value < 0 {
+		return ErrTxNegativeValue
+	}
+	if value > MaxMoneySupply() {
+		return ErrTxValueOverflow
+	}
+	return nil
+}
+
+//不依赖链上数据的交易检查：输入输出不能为空，输出金额合法，同一个输出不能被引用两次
+//TxID必须和重新计算的一致，不能直接相信交易里带的TxID
+func CheckTransaction(tx *Transaction) error {
+	if tx == nil || len(tx.Vins) == 0 {
+		return ErrTxNoInputs
+	}
+	if len(tx.Vouts) == 0 {
+		return ErrTxNoOutputs
+	}
+	for index, vin := range tx.Vins {
+		if vin == nil {
+			return fmt.Errorf("%w: 第%d个输入为空", ErrTxBadInput, index)
+		}
+	}
+	for index, out := range tx.Vouts {
+		if out == nil {
+			return fmt.Errorf("%w: 第%d个输出为空", ErrTxNoOutputs, index)
+		}
+	}
+	if !bytes.Equal(tx.TxID, tx.Hash()) {
+		return fmt.Errorf("%w: %x", ErrTxBadID, tx.TxID)
+	}
+	var total int64
+	for index, out := range tx.Vouts {
+		if err := checkValue(out.Value); err != nil {
+			return fmt.Errorf("%w: 第%d个输出金额%d", err, index, out.Value)
+		}
+		total += out.Value
+		if err := checkValue(total); err != nil {
+			return fmt.Errorf("%w: 输出总额", err)
+		}
+	}
+	//coinbase交易只有一个不引用任何输出的输入
+	if tx.IsCoinbaseTransaction() {
+		if len(tx.Vins) != 1 {
+			return fmt.Errorf("%w: coinbase交易只能有一个输入", ErrTxBadInput)
+		}
+		return nil
+	}
+	seen := make(map[string]bool)
+	for index, vin := range tx.Vins {
+		if len(vin.TxID) == 0 || vin.Vout < 0 {
+			return fmt.Errorf("%w: 第%d个输入", ErrTxBadInput, index)
+		}
+		key := fmt.Sprintf("%s:%d", hex.EncodeToString(vin.TxID), vin.Vout)
+		if seen[key] {
+			return fmt.Errorf("%w: %s", ErrTxDuplicateInput, key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+//检查交易的输入金额：spent[i]是第i个输入引用的输出，由调用者从UTXO表、交易池或者区块里找到
+//输入总额不能小于输出总额，返回手续费
+func CheckTransactionInputs(tx *Transaction, spent []*TXOuput) (int64, error) {
+	if len(spent) != len(tx.Vins) {
+		return 0, fmt.Errorf("%w: 有%d个输入，只找到%d个输出", ErrMissingTxInput, len(tx.Vins), len(spent))
+	}
+	var inputValue int64
+	for index, out := range spent {
+		if out == nil {
+			vin := tx.Vins[index]
+			return 0, fmt.Errorf("%w: %x:%d", ErrMissingTxInput, vin.TxID, vin.Vout)
+		}
+		if err := checkValue(out.Value); err != nil {
+			return 0, fmt.Errorf("%w: 第%d个输入金额%d", err, index, out.Value)
+		}
+		inputValue += out.Value
+		if err := checkValue(inputValue); err != nil {
+			return 0, fmt.Errorf("%w: 输入总额", err)
+		}
+	}
+	outputValue := tx.OutputValue()
+	if outputValue > inputValue {
+		return 0, fmt.Errorf("%w: 输入%d,输出%d", ErrTxInsufficientInput, inputValue, outputValue)
+	}
+	return inputValue - outputValue, nil
+}
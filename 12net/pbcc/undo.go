@@ -0,0 +1,176 @@
+package pbcc
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"publicchain/conf"
+
+	"github.com/boltdb/bolt"
+)
+
+//区块的撤销数据：区块里的交易花掉的UTXO，按花费的顺序存放
+//断开区块时用它把UTXO放回UTXO表，不需要重新扫描整条链
+type BlockUndo struct {
+	SpentUTXOs []*UTXO
+}
+
+//序列化，格式版本号后面依次是花掉的UTXO，格式见encoding.go
+func (undo *BlockUndo) Serialize() []byte {
+	e := NewEncoder()
+	e.WriteUint32(UndoEncodingVersion)
+	e.WriteVarInt(uint64(len(undo.SpentUTXOs)))
+	for _, utxo := range undo.SpentUTXOs {
+		utxo.encode(e)
+	}
+	return e.Bytes()
+}
+
+//反序列化，只用来读取自己数据库里的撤销数据
+func DeserializeBlockUndo(undoBytes []byte) *BlockUndo {
+	d := NewDecoder(undoBytes)
+	if version := d.ReadUint32(); d.Err() == nil && version != UndoEncodingVersion {
+		log.Panicf("%v: 撤销数据格式版本%d", ErrUnknownEncodingVersion, version)
+	}
+	undo := &BlockUndo{}
+	for i, n := 0, d.ReadCount(); i < n && d.Err() == nil; i++ {
+		undo.SpentUTXOs = append(undo.SpentUTXOs, decodeUTXO(d))
+	}
+	if d.Err() == nil && d.Len() > 0 {
+		log.Panic(ErrTrailingBytes)
+	}
+	if d.Err() != nil {
+		log.Panic(d.Err())
+	}
+	return undo
+}
+
+//把区块接到UTXO表上：删除区块花掉的UTXO，增加区块产生的UTXO，并写入撤销数据
+func connectBlock(tx *bolt.Tx, block *Block) error {
+	utxoBucket, err := tx.CreateBucketIfNotExists([]byte(conf.UtxoTableName))
+	if err != nil {
+		return err
+	}
+	undoBucket, err := tx.CreateBucketIfNotExists([]byte(conf.UndoTableName))
+	if err != nil {
+		return err
+	}
+	//UTXO表必须正好停在上一个区块
+	if utxoTip := undoBucket.Get([]byte("l")); utxoTip != nil && !bytes.Equal(utxoTip, block.PrevBlockHash) {
+		return fmt.Errorf("UTXO表当前在区块%x，不能接入区块%x", utxoTip, block.Hash)
+	}
+	undo := &BlockUndo{}
+	//按顺序处理交易，区块里后面的交易可以花前面交易的输出
+	for _, transaction := range block.Txs {
+		if !transaction.IsCoinbaseTransaction() {
+			for _, in := range transaction.Vins {
+				utxo, err := spendUTXO(utxoBucket, in.TxID, in.Vout)
+				if err != nil {
+					return err
+				}
+				//升级上来的旧区块产生时还没有成熟期的规则，不再检查
+				if !utxo.IsMature(block.Height) && block.Height > legacyHeight(tx) {
+					return fmt.Errorf("区块%x花费了还没有成熟的coinbase输出%x:%d", block.Hash, in.TxID, in.Vout)
+				}
+				undo.SpentUTXOs = append(undo.SpentUTXOs, utxo)
+			}
+		}
+		utxos := []*UTXO{}
+		for index, out := range transaction.Vouts {
+			utxos = append(utxos, &UTXO{transaction.TxID, index, out, block.Height, transaction.IsCoinbaseTransaction()})
+		}
+		txOutputs := &TxOutputs{utxos}
+		err := utxoBucket.Put(transaction.TxID, txOutputs.Serilalize())
+		if err != nil {
+			return err
+		}
+	}
+	err = undoBucket.Put(block.Hash, undo.Serialize())
+	if err != nil {
+		return err
+	}
+	return undoBucket.Put([]byte("l"), block.Hash)
+}
+
+//从UTXO表中删掉一个UTXO，并把它返回
+func spendUTXO(utxoBucket *bolt.Bucket, txID []byte, vout int) (*UTXO, error) {
+	txOutputsBytes := utxoBucket.Get(txID)
+	if txOutputsBytes == nil {
+		return nil, fmt.Errorf("UTXO %x:%d 不存在或已经被花费", txID, vout)
+	}
+	txOutputs := DeserializeTXOutputs(txOutputsBytes)
+	var spent *UTXO
+	utxos := []*UTXO{} //存储未花费
+	for _, utxo := range txOutputs.UTXOS {
+		if utxo.Index == vout {
+			spent = utxo
+		} else {
+			utxos = append(utxos, utxo)
+		}
+	}
+	if spent == nil {
+		return nil, fmt.Errorf("UTXO %x:%d 不存在或已经被花费", txID, vout)
+	}
+	if len(utxos) == 0 {
+		return spent, utxoBucket.Delete(txID)
+	}
+	return spent, utxoBucket.Put(txID, (&TxOutputs{utxos}).Serilalize())
+}
+
+//把区块从UTXO表上断开：删除区块产生的UTXO，根据撤销数据放回区块花掉的UTXO
+func disconnectBlock(tx *bolt.Tx, block *Block) error {
+	utxoBucket := tx.Bucket([]byte(conf.UtxoTableName))
+	undoBucket := tx.Bucket([]byte(conf.UndoTableName))
+	if utxoBucket == nil || undoBucket == nil {
+		return fmt.Errorf("区块%x没有撤销数据", block.Hash)
+	}
+	if utxoTip := undoBucket.Get([]byte("l")); !bytes.Equal(utxoTip, block.Hash) {
+		return fmt.Errorf("UTXO表当前在区块%x，不能断开区块%x", utxoTip, block.Hash)
+	}
+	undoBytes := undoBucket.Get(block.Hash)
+	if undoBytes == nil {
+		return fmt.Errorf("区块%x没有撤销数据", block.Hash)
+	}
+	spentUTXOs := DeserializeBlockUndo(undoBytes).SpentUTXOs
+	//倒着处理交易，先删掉交易产生的输出，再放回它花掉的输出
+	for i := len(block.Txs) - 1; i >= 0; i-- {
+		transaction := block.Txs[i]
+		err := utxoBucket.Delete(transaction.TxID)
+		if err != nil {
+			return err
+		}
+		if transaction.IsCoinbaseTransaction() {
+			continue
+		}
+		for range transaction.Vins {
+			if len(spentUTXOs) == 0 {
+				return fmt.Errorf("区块%x的撤销数据不完整", block.Hash)
+			}
+			utxo := spentUTXOs[len(spentUTXOs)-1]
+			spentUTXOs = spentUTXOs[:len(spentUTXOs)-1]
+			txOutputs := &TxOutputs{[]*UTXO{}}
+			if txOutputsBytes := utxoBucket.Get(utxo.TxID); txOutputsBytes != nil {
+				txOutputs = DeserializeTXOutputs(txOutputsBytes)
+			}
+			txOutputs.UTXOS = append(txOutputs.UTXOS, utxo)
+			err := utxoBucket.Put(utxo.TxID, txOutputs.Serilalize())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := undoBucket.Delete(block.Hash)
+	if err != nil {
+		return err
+	}
+	return undoBucket.Put([]byte("l"), block.PrevBlockHash)
+}
+
+//获取UTXO表当前对应的区块hash，没有记录时返回nil
+func utxoTipHash(tx *bolt.Tx) []byte {
+	undoBucket := tx.Bucket([]byte(conf.UndoTableName))
+	if undoBucket == nil {
+		return nil
+	}
+	return undoBucket.Get([]byte("l"))
+}
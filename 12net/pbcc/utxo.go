@@ -1,8 +1,18 @@
 package pbcc
 
+import "publicchain/conf"
+
 //结构体UTXO，用于表示未花费的钱
 type UTXO struct {
-	TxID   []byte   //当前Transaction的交易ID
-	Index  int      //这个在交易的输出的下标索引
-	Output *TXOuput //输出
+	TxID     []byte   //当前Transaction的交易ID
+	Index    int      //这个在交易的输出的下标索引
+	Output   *TXOuput //输出
+	Height   int64    //交易所在区块的高度
+	Coinbase bool     //是否是coinbase交易的输出
+}
+
+//判断UTXO能不能被高度为spendHeight的区块里的交易花费
+//coinbase交易的输出要等CoinbaseMaturity个区块以后才能花，防止分叉时区块奖励消失导致后面的交易全部失效
+func (utxo *UTXO) IsMature(spendHeight int64) bool {
+	return !utxo.Coinbase || spendHeight-utxo.Height >= conf.CoinbaseMaturity
 }
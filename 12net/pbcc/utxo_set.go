@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"publicchain/conf"
-	"publicchain/wallet"
 
 	"github.com/boltdb/bolt"
 )
@@ -17,30 +16,33 @@ type UTXOSet struct {
 	BlockChain *BlockChain
 }
 
-//重置UXTO_SET数据库表
+//重置UXTO_SET数据库表：清空以后从创世区块开始把主链上的区块依次接上去，同时生成撤销数据
 func (utxoSet *UTXOSet) ResetUTXOSet() {
+	//从tip往前收集主链上的区块，再倒过来
+	var blocks []*Block
+	iterator := utxoSet.BlockChain.Iterator()
+	for {
+		block := iterator.Next()
+		blocks = append(blocks, block)
+		if block.isGenesis() {
+			break
+		}
+	}
 	err := utxoSet.BlockChain.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(conf.UtxoTableName))
-		if b != nil {
-			err := tx.DeleteBucket([]byte(conf.UtxoTableName))
-			if err != nil {
-				log.Panic("重置中，删除表失败")
+		for _, tableName := range []string{conf.UtxoTableName, conf.UndoTableName} {
+			if tx.Bucket([]byte(tableName)) != nil {
+				err := tx.DeleteBucket([]byte(tableName))
+				if err != nil {
+					log.Panic("重置中，删除表失败")
+				}
 			}
-
-		}
-		b, err := tx.CreateBucket([]byte(conf.UtxoTableName))
-		if err != nil {
-			log.Panic("重置中，创建新表失败")
 		}
-		if b != nil {
-			txOutputMap := utxoSet.BlockChain.FindUnSpentOutputMap()
-			//fmt.Println("未花费outputmap：",txOutputMap)
-			for txIDStr, outputs := range txOutputMap {
-				txID, _ := hex.DecodeString(txIDStr)
-				b.Put(txID, outputs.Serilalize())
+		for i := len(blocks) - 1; i >= 0; i-- {
+			err := connectBlock(tx, blocks[i])
+			if err != nil {
+				return err
 			}
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -75,7 +77,8 @@ func (utxoSet *UTXOSet) FindSpendableUTXOs(from string, amount int64, txs []*Tra
 		}
 	}
 	//钱不够
-	//找出已经存在数据库中的未花费的
+	//找出已经存在数据库中的未花费的，还没成熟的coinbase输出不能用
+	spendHeight := utxoSet.BlockChain.GetBestHeight() + 1
 	err := utxoSet.BlockChain.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(conf.UtxoTableName))
 		if b != nil {
@@ -84,7 +87,7 @@ func (utxoSet *UTXOSet) FindSpendableUTXOs(from string, amount int64, txs []*Tra
 			for k, v := c.First(); k != nil; k, v = c.Next() {
 				txOutpus := DeserializeTXOutputs(v)
 				for _, utxo := range txOutpus.UTXOS {
-					if utxo.Output.UnLockWithAddress(from) {
+					if utxo.Output.UnLockWithAddress(from) && utxo.IsMature(spendHeight) {
 						total += utxo.Output.Value
 						txIDStr := hex.EncodeToString(utxo.TxID)
 						spentableUTXO[txIDStr] = append(spentableUTXO[txIDStr], utxo.Index)
@@ -110,110 +113,72 @@ func (utxoSet *UTXOSet) FindSpendableUTXOs(from string, amount int64, txs []*Tra
 	return total, spentableUTXO
 }
 
-//每次创建区块后(在这里就是每次交易以后)，更新未花费的表
+//每次创建区块后(在这里就是每次交易以后)，把最新的区块接到UTXO表上
 func (utxoSet *UTXOSet) Update() {
-	/*
-		每当创建新区块后，都会花掉一些原来的utxo，产生新的utxo。
-		删除已经花费的，增加新产生的未花费
-		表中存储的数据结构：
-		key：交易ID
-		value：TxInputs
-			TxInputs里是UTXO数组
+	//获取最新的区块
+	newBlock := utxoSet.BlockChain.Iterator().Next()
+	err := utxoSet.ConnectBlock(newBlock)
+	if err != nil {
+		log.Panic(err)
+	}
+}
 
-	*/
+//把区块接到UTXO表上，同时写入区块的撤销数据
+func (utxoSet *UTXOSet) ConnectBlock(block *Block) error {
+	return utxoSet.BlockChain.DB.Update(func(tx *bolt.Tx) error {
+		return connectBlock(tx, block)
+	})
+}
 
-	//获取最新的区块，由于该block的产生，
-	newBlock := utxoSet.BlockChain.Iterator().Next()
+//根据撤销数据把区块从UTXO表上断开，只需要处理这个区块里的交易
+func (utxoSet *UTXOSet) DisconnectBlock(block *Block) error {
+	return utxoSet.BlockChain.DB.Update(func(tx *bolt.Tx) error {
+		return disconnectBlock(tx, block)
+	})
+}
 
-	//遍历该区块的交易
-	inputs := []*TXInput{}
-	//未花费
-	outsMap := make(map[string]*TxOutputs)
-	//获取已经花费的
-	for _, tx := range newBlock.Txs {
-		if tx.IsCoinbaseTransaction() {
-			continue
-		}
-		for _, in := range tx.Vins {
-			inputs = append(inputs, in)
-		}
+//节点启动时检查UTXO表是否和主链的tip一致
+//比如存了区块以后还没来得及更新UTXO表就崩溃了，这时只断开和接入相差的区块，不用全部重新扫描
+func (utxoSet *UTXOSet) Recover() error {
+	bc := utxoSet.BlockChain
+	var utxoTip []byte
+	bc.DB.View(func(tx *bolt.Tx) error {
+		utxoTip = utxoTipHash(tx)
+		return nil
+	})
+	if utxoTip == nil {
+		//没有记录UTXO表的位置，只能全部重建
+		fmt.Println("UTXO表没有记录对应的区块，重建UTXO表")
+		utxoSet.ResetUTXOSet()
+		return nil
 	}
-	fmt.Println("inputs的长度:", len(inputs), inputs)
-	//以上是找出新添加的区块中的所有的Input
-	//以下是找到新添加的区块中的未花费了的Output
-	for _, tx := range newBlock.Txs {
-		utoxs := []*UTXO{}
-	outLoop:
-		for index, out := range tx.Vouts {
-			isSpent := false
-			for _, in := range inputs {
-				if bytes.Equal(in.TxID, tx.TxID) && in.Vout == index && bytes.Equal(out.PubKeyHash, wallet.PubKeyHash(in.PublicKey)) {
-					isSpent = true
-					continue outLoop
-				}
-			}
-			if !isSpent {
-				utxo := &UTXO{tx.TxID, index, out}
-				utoxs = append(utoxs, utxo)
-				fmt.Println("outsMaps,", out.Value)
-			}
+	tip := bc.GetTipHash()
+	if bytes.Equal(utxoTip, tip) {
+		return nil
+	}
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
+		tipBytes := b.Get(tip)
+		if tipBytes == nil {
+			return fmt.Errorf("区块%x不存在", tip)
 		}
-		if len(utoxs) > 0 {
-			txIDStr := hex.EncodeToString(tx.TxID)
-			outsMap[txIDStr] = &TxOutputs{utoxs}
+		change, err := findTipChange(b, utxoTip, DeserializeBlock(tipBytes))
+		if err != nil {
+			return err
 		}
-
-	}
-	fmt.Println("outsMap的长度:", len(outsMap), outsMap)
-
-	//删除已经花费了的
-	err := utxoSet.BlockChain.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(conf.UtxoTableName))
-		if b != nil {
-			//删除 ins中
-			for i := 0; i < len(inputs); i++ {
-				in := inputs[i]
-				fmt.Println(i, "=========================")
-				txOutputsBytes := b.Get(in.TxID)
-				if len(txOutputsBytes) == 0 {
-					//fmt.Println("break",i)
-					continue
-				}
-				txOutputs := DeserializeTXOutputs(txOutputsBytes)
-				//根据IxID，如果该txOutputs中已经有output被新区块花掉了，那么将未花掉的添加到utxos里，并标记该txouputs要删除
-				// 判断是否需要
-				isNeedDelete := false
-				utxos := []*UTXO{} //存储未花费
-				for _, utxo := range txOutputs.UTXOS {
-					if bytes.Equal(utxo.Output.PubKeyHash, wallet.PubKeyHash(in.PublicKey)) && in.Vout == utxo.Index {
-						isNeedDelete = true
-					} else {
-						utxos = append(utxos, utxo)
-					}
-				}
-				fmt.Println(len(utxos))
-				if isNeedDelete {
-					b.Delete(in.TxID)
-					if len(utxos) > 0 {
-
-						txOutputs := &TxOutputs{utxos}
-						b.Put(in.TxID, txOutputs.Serilalize())
-						fmt.Println("删除时:map:", len(outsMap), outsMap)
-					}
-
-				}
+		fmt.Printf("恢复UTXO表：断开%d个区块，接入%d个区块\n", len(change.Disconnected), len(change.Connected))
+		for _, block := range change.Disconnected {
+			if err := disconnectBlock(tx, block); err != nil {
+				return err
 			}
-			//增加
-			for keyID, outPuts := range outsMap {
-				keyHashBytes, _ := hex.DecodeString(keyID)
-				b.Put(keyHashBytes, outPuts.Serilalize())
+		}
+		for _, block := range change.Connected {
+			if err := connectBlock(tx, block); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
-	if err != nil {
-		log.Panic(err)
-	}
 }
 
 // 获取地址余额
@@ -252,3 +217,28 @@ func (utxoSet *UTXOSet) FindUnspentOutputsForAddress(address string) []*UTXO {
 	}
 	return utxos
 }
+
+// 根据交易ID和输出下标查找一个未花费的输出，找不到时返回nil
+func (utxoSet *UTXOSet) FindUTXO(txID []byte, index int) *UTXO {
+	var found *UTXO
+	err := utxoSet.BlockChain.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(conf.UtxoTableName))
+		if b == nil {
+			return nil
+		}
+		txOutputsBytes := b.Get(txID)
+		if txOutputsBytes == nil {
+			return nil
+		}
+		for _, utxo := range DeserializeTXOutputs(txOutputsBytes).UTXOS {
+			if utxo.Index == index {
+				found = utxo
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	return found
+}
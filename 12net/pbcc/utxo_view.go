@@ -0,0 +1,133 @@
+package pbcc
+
+import (
+	"bytes"
+	"fmt"
+	"publicchain/conf"
+
+	"github.com/boltdb/bolt"
+)
+
+// 校验区块时使用的UTXO视图：在UTXO表上叠加一层还没有写入数据库的修改
+// UTXO表只对应主链，上一个区块在分叉链上时，先用撤销数据把主链退回到分叉点，再把分叉链上的区块接上去
+// 只需要处理两条链分叉以后的区块，不用扫描整条链
+type utxoView struct {
+	utxos   *bolt.Bucket     // UTXO表，可以为nil
+	changed map[string]*UTXO // 输出 -> 修改以后的UTXO，nil表示已经被花掉
+}
+
+// 在数据库事务中创建对应blockHash这个区块之后状态的UTXO视图
+func newUTXOView(tx *bolt.Tx, blockHash []byte) (*utxoView, error) {
+	view := &utxoView{tx.Bucket([]byte(conf.UtxoTableName)), make(map[string]*UTXO)}
+	utxoTip := utxoTipHash(tx)
+	if utxoTip == nil {
+		return nil, fmt.Errorf("UTXO表没有记录对应的区块")
+	}
+	if bytes.Equal(utxoTip, blockHash) {
+		return view, nil
+	}
+	b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
+	block, err := bucketBlockGetter(b)(blockHash)
+	if err != nil {
+		return nil, err
+	}
+	change, err := findTipChange(b, utxoTip, block)
+	if err != nil {
+		return nil, err
+	}
+	undoBucket := tx.Bucket([]byte(conf.UndoTableName))
+	for _, disconnected := range change.Disconnected {
+		undoBytes := undoBucket.Get(disconnected.Hash)
+		if undoBytes == nil {
+			return nil, fmt.Errorf("区块%x没有撤销数据", disconnected.Hash)
+		}
+		if err := view.disconnectBlock(disconnected, DeserializeBlockUndo(undoBytes)); err != nil {
+			return nil, err
+		}
+	}
+	for _, connected := range change.Connected {
+		if err := view.connectBlock(connected); err != nil {
+			return nil, err
+		}
+	}
+	return view, nil
+}
+
+// 查找一个还没有被花掉的输出，找不到时返回nil
+func (view *utxoView) lookup(txID []byte, index int) *UTXO {
+	if utxo, ok := view.changed[outpointKey(txID, index)]; ok {
+		return utxo
+	}
+	if view.utxos == nil {
+		return nil
+	}
+	txOutputsBytes := view.utxos.Get(txID)
+	if txOutputsBytes == nil {
+		return nil
+	}
+	for _, utxo := range DeserializeTXOutputs(txOutputsBytes).UTXOS {
+		if utxo.Index == index {
+			return utxo
+		}
+	}
+	return nil
+}
+
+// 花掉一个输出并返回它，不存在或者已经被花掉时返回nil
+func (view *utxoView) spend(txID []byte, index int) *UTXO {
+	utxo := view.lookup(txID, index)
+	if utxo != nil {
+		view.changed[outpointKey(txID, index)] = nil
+	}
+	return utxo
+}
+
+// 加入交易产生的输出
+func (view *utxoView) addTransaction(tx *Transaction, height int64) {
+	for index, out := range tx.Vouts {
+		view.changed[outpointKey(tx.TxID, index)] = &UTXO{tx.TxID, index, out, height, tx.IsCoinbaseTransaction()}
+	}
+}
+
+// 把已经存下来的分叉链区块接到视图上，这些区块存储前已经校验过
+func (view *utxoView) connectBlock(block *Block) error {
+	for _, tx := range block.Txs {
+		if !tx.IsCoinbaseTransaction() {
+			for _, in := range tx.Vins {
+				if view.spend(in.TxID, in.Vout) == nil {
+					return fmt.Errorf("区块%x花费的输出%x:%d不存在", block.Hash, in.TxID, in.Vout)
+				}
+			}
+		}
+		view.addTransaction(tx, block.Height)
+	}
+	return nil
+}
+
+// 根据撤销数据把主链上的区块从视图上断开，和disconnectBlock的顺序一样
+func (view *utxoView) disconnectBlock(block *Block, undo *BlockUndo) error {
+	spentUTXOs := undo.SpentUTXOs
+	for i := len(block.Txs) - 1; i >= 0; i-- {
+		tx := block.Txs[i]
+		for index := range tx.Vouts {
+			view.changed[outpointKey(tx.TxID, index)] = nil
+		}
+		if tx.IsCoinbaseTransaction() {
+			continue
+		}
+		for range tx.Vins {
+			if len(spentUTXOs) == 0 {
+				return fmt.Errorf("区块%x的撤销数据不完整", block.Hash)
+			}
+			utxo := spentUTXOs[len(spentUTXOs)-1]
+			spentUTXOs = spentUTXOs[:len(spentUTXOs)-1]
+			view.changed[outpointKey(utxo.TxID, utxo.Index)] = utxo
+		}
+	}
+	return nil
+}
+
+// 输出的唯一标识：交易ID:下标
+func outpointKey(txID []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txID, index)
+}
@@ -0,0 +1,223 @@
+package pbcc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"publicchain/conf"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// 区块校验失败的错误类型，可以用 errors.Is 判断具体原因
+var (
+	ErrNoTransactions    = errors.New("区块中没有交易")
+	ErrHashMismatch      = errors.New("区块hash与区块内容不符")
+	ErrInvalidPoW        = errors.New("区块hash不满足工作量证明的难度要求")
+	ErrPrevBlockNotFound = errors.New("找不到上一个区块")
+	ErrBadHeight         = errors.New("区块高度不连续")
+	ErrBadDifficulty     = errors.New("区块的难度目标不符合难度调整规则")
+	ErrBadTimestamp      = errors.New("区块时间戳不合法")
+	ErrBadCoinbase       = errors.New("coinbase交易不合法")
+	ErrBadTransaction    = errors.New("交易格式不合法")
+	ErrMissingTxInput    = errors.New("交易输入引用的输出不存在或者已经被花费")
+	ErrBadTxSignature    = errors.New("交易签名验证失败")
+	ErrBlockTooLarge     = errors.New("区块超过大小上限")
+	ErrBadMerkleRoot     = errors.New("区块头的默克尔根与交易不符")
+	ErrDoubleSpend       = errors.New("交易输入引用的输出已经被花费")
+	ErrImmatureSpend     = errors.New("交易花费了还没有成熟的coinbase输出")
+	ErrInvalidChain      = errors.New("区块所在的链不合法")
+)
+
+// 区块校验错误，携带出错区块的hash和具体描述
+type ValidationError struct {
+	Code   error  // 错误类型，取值为上面定义的Err*
+	Hash   []byte // 出错区块的hash
+	Reason string // 错误描述
+}
+
+func (e *ValidationError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("区块%x校验失败: %v", e.Hash, e.Code)
+	}
+	return fmt.Sprintf("区块%x校验失败: %v: %s", e.Hash, e.Code, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Code
+}
+
+// 创建一个区块校验错误
+func newValidationError(hash []byte, code error, format string, args ...interface{}) error {
+	return &ValidationError{code, hash, fmt.Sprintf(format, args...)}
+}
+
+// 校验一个从其他节点收到的区块，全部通过才返回nil
+func (bc *BlockChain) ValidateBlock(block *Block) error {
+	return bc.DB.View(func(tx *bolt.Tx) error {
+		return validateBlock(tx, block)
+	})
+}
+
+// 在数据库事务中校验区块，交易的输入从上一个区块之后的UTXO视图里查找
+func validateBlock(tx *bolt.Tx, block *Block) error {
+	//1.区块里至少要有一笔coinbase交易
+	if len(block.Txs) == 0 {
+		return newValidationError(block.Hash, ErrNoTransactions, "")
+	}
+	if size := len(block.Serilalize()); size > conf.MaxBlockSize {
+		return newValidationError(block.Hash, ErrBlockTooLarge, "区块大小:%d", size)
+	}
+	//2.校验区块头
+	if err := validateHeader(tx, &block.BlockHeader, block.Hash); err != nil {
+		return err
+	}
+	//3.上一个区块不能只有区块头，交易的输入要从前面的区块里查找
+	if tx.Bucket([]byte(conf.BLOCKTABLENAME)).Get(block.PrevBlockHash) == nil {
+		return newValidationError(block.Hash, ErrPrevBlockNotFound, "上一个区块还没有下载:%x", block.PrevBlockHash)
+	}
+	//4.区块头里的默克尔根必须和交易算出来的一致，hash只包含区块头，交易被篡改要在这里发现
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return newValidationError(block.Hash, ErrBadMerkleRoot, "")
+	}
+	//5.校验交易
+	view, err := newUTXOView(tx, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	return validateBlockTransactions(block, view)
+}
+
+// 校验区块头，不需要区块里的交易，收到区块头时就可以先校验
+func (bc *BlockChain) ValidateHeader(header *BlockHeader, hash []byte) error {
+	return bc.DB.View(func(tx *bolt.Tx) error {
+		return validateHeader(tx, header, hash)
+	})
+}
+
+// 在数据库事务中校验区块头
+func validateHeader(tx *bolt.Tx, header *BlockHeader, hash []byte) error {
+	getHeader := txHeaderGetter(tx)
+	//接入失败被标记为不合法的区块，以及接在它后面的区块，都直接拒绝
+	if isInvalid(tx, hash) || isInvalid(tx, header.PrevBlockHash) {
+		return newValidationError(hash, ErrInvalidChain, "")
+	}
+	//1.重新计算hash，不能直接相信区块里带的Hash
+	pow := NewProofOfWork(&Block{BlockHeader: *header, Hash: hash})
+	if !bytes.Equal(pow.CalculateHash(), hash) {
+		return newValidationError(hash, ErrHashMismatch, "")
+	}
+	if !pow.IsValid() {
+		return newValidationError(hash, ErrInvalidPoW, "")
+	}
+	//2.上一个区块必须存在，并且高度连续
+	prevHeader, err := getHeader(header.PrevBlockHash)
+	if err != nil {
+		return newValidationError(hash, ErrPrevBlockNotFound, "上一个区块:%x", header.PrevBlockHash)
+	}
+	if header.Height != prevHeader.Height+1 {
+		return newValidationError(hash, ErrBadHeight, "上一个区块高度:%d,当前区块高度:%d", prevHeader.Height, header.Height)
+	}
+	//3.难度目标必须和难度调整规则算出来的一致
+	bits, err := calcNextBits(prevHeader, getHeader)
+	if err != nil {
+		return err
+	}
+	if header.Bits != bits {
+		return newValidationError(hash, ErrBadDifficulty, "区块难度:%08x,应该是:%08x", header.Bits, bits)
+	}
+	//4.时间戳不能早于过去区块时间的中位数，也不能比当前时间晚太多，难度调整依赖时间戳
+	medianTime, err := medianTimePast(prevHeader, getHeader)
+	if err != nil {
+		return err
+	}
+	if header.TimeStamp < medianTime {
+		return newValidationError(hash, ErrBadTimestamp, "区块时间戳早于过去区块时间的中位数")
+	}
+	if header.TimeStamp > time.Now().Unix()+conf.MaxFutureBlockTime {
+		return newValidationError(hash, ErrBadTimestamp, "区块时间戳比当前时间晚太多")
+	}
+	return nil
+}
+
+// 校验区块中的交易：第一笔必须是coinbase，其余交易的签名必须有效
+// 普通交易的输出不能大于输入，coinbase最多只能领取这个高度的区块奖励加上所有手续费
+// view是上一个区块之后的UTXO视图，区块里前面的交易产生的输出也会加进去，可以被后面的交易花费
+func validateBlockTransactions(block *Block, view *utxoView) error {
+	for index, tx := range block.Txs {
+		if err := CheckTransaction(tx); err != nil {
+			return newValidationError(block.Hash, ErrBadTransaction, "第%d笔交易: %v", index, err)
+		}
+		isCoinbase := tx.IsCoinbaseTransaction()
+		if index == 0 && !isCoinbase {
+			return newValidationError(block.Hash, ErrBadCoinbase, "第一笔交易必须是coinbase交易")
+		}
+		if index > 0 && isCoinbase {
+			return newValidationError(block.Hash, ErrBadCoinbase, "第%d笔交易是多余的coinbase交易", index)
+		}
+	}
+
+	spentInBlock := make(map[string]bool) //区块里已经被花掉的输出，同一个输出只能花一次
+	var fees int64
+	for index, tx := range block.Txs {
+		if index > 0 {
+			var spent []*TXOuput
+			for _, vin := range tx.Vins {
+				outpoint := outpointKey(vin.TxID, vin.Vout)
+				if spentInBlock[outpoint] {
+					return newValidationError(block.Hash, ErrDoubleSpend, "区块里有多笔交易花费了%s", outpoint)
+				}
+				spentInBlock[outpoint] = true
+				utxo := view.spend(vin.TxID, vin.Vout)
+				if utxo == nil {
+					return newValidationError(block.Hash, ErrMissingTxInput, "交易%x引用了%s", tx.TxID, outpoint)
+				}
+				if !utxo.IsMature(block.Height) {
+					return newValidationError(block.Hash, ErrImmatureSpend, "交易%x引用了%s", tx.TxID, outpoint)
+				}
+				spent = append(spent, utxo.Output)
+			}
+			//签名用上面已经找到的输出验证，不再读取区块链
+			if !tx.VerifySignatures(spent) {
+				return newValidationError(block.Hash, ErrBadTxSignature, "交易%x", tx.TxID)
+			}
+			//手续费 = 输入总额 - 输出总额
+			fee, err := CheckTransactionInputs(tx, spent)
+			if err != nil {
+				return newValidationError(block.Hash, ErrBadTransaction, "交易%x: %v", tx.TxID, err)
+			}
+			fees += fee
+			if err := checkValue(fees); err != nil {
+				return newValidationError(block.Hash, ErrBadTransaction, "手续费总额: %v", err)
+			}
+		}
+		view.addTransaction(tx, block.Height)
+	}
+	if reward, limit := block.Txs[0].OutputValue(), CalcBlockSubsidy(block.Height)+fees; reward > limit {
+		return newValidationError(block.Hash, ErrBadCoinbase, "coinbase领取了%d,最多只能领取%d", reward, limit)
+	}
+	return nil
+}
+
+// 把接入UTXO表失败的区块记为不合法，以后不再尝试切换到它所在的链
+func (bc *BlockChain) markInvalid(hashes ...[]byte) error {
+	return bc.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(conf.InvalidTableName))
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if err := b.Put(hash, []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 区块是否已经被标记为不合法
+func isInvalid(tx *bolt.Tx, hash []byte) bool {
+	b := tx.Bucket([]byte(conf.InvalidTableName))
+	return b != nil && b.Get(hash) != nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"publicchain/conf"
+	"publicchain/crypto"
+	"publicchain/pbcc"
+	"time"
+)
+
+// 不启动节点服务也能向节点提交交易，命令行客户端使用
+// 连上节点完成握手后发送交易，然后断开连接
+func SubmitTx(toAddress string, bestHeight int64, tx *pbcc.Transaction) error {
+	conn, err := net.DialTimeout(conf.PROTOCOL, toAddress, conf.DialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// 客户端没有固定的身份，每次用临时生成的密钥加密
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		return err
+	}
+	secureConn, err := secureOutbound(conn, key)
+	if err != nil {
+		return err
+	}
+	secureConn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	// 客户端不监听端口，节点地址为空，节点不会向它同步数据
+	version := newVersion(bestHeight, conf.SERVICE_LIGHT, "", randomNonce())
+	if err := writeMessage(secureConn, conf.COMMAND_VERSION, encodePayload(&version)); err != nil {
+		return err
+	}
+	versionReceived, verackReceived := false, false
+	for !versionReceived || !verackReceived {
+		command, payload, err := readMessage(secureConn)
+		if err != nil {
+			return err
+		}
+		switch command {
+		case conf.COMMAND_VERSION:
+			var remote Version
+			if err := decodePayload(payload, &remote); err != nil {
+				return err
+			}
+			if remote.Version < conf.MIN_NODE_VERSION {
+				return fmt.Errorf("节点%s的协议版本%d太低", toAddress, remote.Version)
+			}
+			if err := writeMessage(secureConn, conf.COMMAND_VERACK, nil); err != nil {
+				return err
+			}
+			versionReceived = true
+		case conf.COMMAND_VERACK:
+			verackReceived = true
+		}
+	}
+	fmt.Printf("向节点%s提交了交易%x\n", toAddress, tx.TxID)
+	return writeMessage(secureConn, conf.COMMAND_TX, encodePayload(&Tx{tx.Serialize()}))
+}
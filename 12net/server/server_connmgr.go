@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"publicchain/conf"
+	"time"
+)
+
+// 连接管理：定时检查主动连接的节点数量，不够就从地址簿里挑选地址去连接，顺便保存地址簿
+// ctx取消时返回
+func (n *Node) connectionManager(ctx context.Context) {
+	ticker := time.NewTicker(conf.ConnectInterval)
+	defer ticker.Stop()
+	for {
+		n.maintainOutbound()
+		if err := n.addrBook.Save(); err != nil {
+			fmt.Println("保存地址簿失败:", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 主动连接地址簿里的节点，直到数量达到conf.TargetOutboundPeers，被封禁的节点不连接
+func (n *Node) maintainOutbound() {
+	exclude, outbound := n.connectedPeers()
+	exclude[n.address] = true
+	for _, ban := range n.banList.List() {
+		exclude[ban.Addr] = true
+	}
+	for ; outbound < conf.TargetOutboundPeers; outbound++ {
+		addr := n.addrBook.Select(exclude)
+		if addr == "" {
+			return
+		}
+		exclude[addr] = true
+		n.addrBook.Attempt(addr)
+		if _, err := n.connectPeer(addr); err != nil {
+			fmt.Printf("连接节点%s失败: %v\n", addr, err)
+			n.addrBook.Failed(addr)
+		}
+	}
+}
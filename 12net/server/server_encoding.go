@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"publicchain/conf"
+	"publicchain/pbcc"
+)
+
+/*
+	消息内容的二进制编码，和区块、交易使用同一种编码规则（见pbcc/encoding.go）：
+		1.整数用大端字节序定长写入，int64和uint64占8个字节
+		2.字符串和字节数组先写varint长度，再写内容
+		3.数组先写varint元素个数，再依次写每个元素
+		4.结构体的字段按下面encode里的顺序依次写入，没有字段名
+	消息格式变化时提高conf.NODE_VERSION，不需要每条消息带格式版本
+*/
+
+// 可以放进消息里传输的内容
+type payload interface {
+	encode(e *pbcc.Encoder)
+	decode(d *pbcc.Decoder)
+}
+
+// 编码消息内容
+func encodePayload(p payload) []byte {
+	e := pbcc.NewEncoder()
+	p.encode(e)
+	return e.Bytes()
+}
+
+// 解码消息内容，格式不对或者后面有多余的数据，说明对方发来的消息不合法
+func decodePayload(data []byte, p payload) error {
+	d := pbcc.NewDecoder(data)
+	p.decode(d)
+	err := d.Err()
+	if err == nil && d.Len() > 0 {
+		err = pbcc.ErrTrailingBytes
+	}
+	if err != nil {
+		return misbehavior(conf.ScoreMalformedMessage, fmt.Errorf("消息解析失败: %v", err))
+	}
+	return nil
+}
+
+func writeString(e *pbcc.Encoder, s string) {
+	e.WriteVarBytes([]byte(s))
+}
+
+func readString(d *pbcc.Decoder) string {
+	return string(d.ReadVarBytes())
+}
+
+// 写入hash之类的字节数组列表
+func writeHashes(e *pbcc.Encoder, hashes [][]byte) {
+	e.WriteVarInt(uint64(len(hashes)))
+	for _, hash := range hashes {
+		e.WriteVarBytes(hash)
+	}
+}
+
+// 读出字节数组列表，个数不会超过剩下的字节数
+func readHashes(d *pbcc.Decoder) [][]byte {
+	var hashes [][]byte
+	for i, n := 0, d.ReadCount(); i < n && d.Err() == nil; i++ {
+		hashes = append(hashes, d.ReadVarBytes())
+	}
+	return hashes
+}
+
+func (v *Version) encode(e *pbcc.Encoder) {
+	e.WriteInt64(v.Version)
+	e.WriteUint64(v.Services)
+	e.WriteInt64(v.Timestamp)
+	e.WriteUint64(v.Nonce)
+	writeString(e, v.UserAgent)
+	e.WriteInt64(v.BestHeight)
+	writeString(e, v.AddrFrom)
+}
+
+func (v *Version) decode(d *pbcc.Decoder) {
+	v.Version = d.ReadInt64()
+	v.Services = d.ReadUint64()
+	v.Timestamp = d.ReadInt64()
+	v.Nonce = d.ReadUint64()
+	v.UserAgent = readString(d)
+	v.BestHeight = d.ReadInt64()
+	v.AddrFrom = readString(d)
+}
+
+func (m *GetHeaders) encode(e *pbcc.Encoder) {
+	writeHashes(e, m.Locator)
+	e.WriteVarBytes(m.StopHash)
+}
+
+func (m *GetHeaders) decode(d *pbcc.Decoder) {
+	m.Locator = readHashes(d)
+	m.StopHash = d.ReadVarBytes()
+}
+
+func (m *Headers) encode(e *pbcc.Encoder) {
+	writeHashes(e, m.Headers)
+}
+
+func (m *Headers) decode(d *pbcc.Decoder) {
+	m.Headers = readHashes(d)
+}
+
+func (m *Addr) encode(e *pbcc.Encoder) {
+	e.WriteVarInt(uint64(len(m.Addrs)))
+	for _, addr := range m.Addrs {
+		writeString(e, addr.Addr)
+		e.WriteUint64(addr.Services)
+		e.WriteInt64(addr.Timestamp)
+	}
+}
+
+func (m *Addr) decode(d *pbcc.Decoder) {
+	for i, n := 0, d.ReadCount(); i < n && d.Err() == nil; i++ {
+		var addr NetAddress
+		addr.Addr = readString(d)
+		addr.Services = d.ReadUint64()
+		addr.Timestamp = d.ReadInt64()
+		m.Addrs = append(m.Addrs, addr)
+	}
+}
+
+func (m *Inv) encode(e *pbcc.Encoder) {
+	writeString(e, m.Type)
+	writeHashes(e, m.Items)
+}
+
+func (m *Inv) decode(d *pbcc.Decoder) {
+	m.Type = readString(d)
+	m.Items = readHashes(d)
+}
+
+func (m *GetData) encode(e *pbcc.Encoder) {
+	writeString(e, m.Type)
+	e.WriteVarBytes(m.Hash)
+}
+
+func (m *GetData) decode(d *pbcc.Decoder) {
+	m.Type = readString(d)
+	m.Hash = d.ReadVarBytes()
+}
+
+func (m *NotFound) encode(e *pbcc.Encoder) {
+	writeString(e, m.Type)
+	writeHashes(e, m.Items)
+}
+
+func (m *NotFound) decode(d *pbcc.Decoder) {
+	m.Type = readString(d)
+	m.Items = readHashes(d)
+}
+
+func (m *BlockData) encode(e *pbcc.Encoder) {
+	e.WriteVarBytes(m.Block)
+}
+
+func (m *BlockData) decode(d *pbcc.Decoder) {
+	m.Block = d.ReadVarBytes()
+}
+
+func (m *Tx) encode(e *pbcc.Encoder) {
+	e.WriteVarBytes(m.Tx)
+}
+
+func (m *Tx) decode(d *pbcc.Decoder) {
+	m.Tx = d.ReadVarBytes()
+}
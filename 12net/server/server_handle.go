@@ -1,238 +1,349 @@
 package server
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"publicchain/conf"
 	"publicchain/pbcc"
-
-	"github.com/boltdb/bolt"
+	"time"
 )
 
 // 处理版本消息
-func handleVersion(request []byte, bc *pbcc.BlockChain) {
+func (n *Node) handleVersion(peer *Peer, data []byte) error {
 
-	var buff bytes.Buffer
 	var payload Version
-	// 从请求中截出数据
-	dataBytes := request[conf.COMMANDLENGTH:]
-
 	// 反序列化 解析请求数据中的version消息到payload
-	buff.Write(dataBytes)
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+	// 收到的随机数和自己的一样，说明连上了自己
+	if payload.Nonce == n.nonce {
+		fmt.Println("连上了自己，断开连接")
+		peer.disconnect()
+		return nil
+	}
+	// 协议版本太低的节点不能通信
+	if payload.Version < conf.MIN_NODE_VERSION {
+		fmt.Printf("节点%s的协议版本%d太低，最低需要%d\n", peer, payload.Version, conf.MIN_NODE_VERSION)
+		peer.disconnect()
+		return nil
+	}
+	// 被封禁的节点不接受它连进来
+	if payload.AddrFrom != "" && n.banList.IsBanned(payload.AddrFrom) {
+		fmt.Printf("节点%s已经被封禁，断开连接\n", payload.AddrFrom)
+		peer.disconnect()
+		return nil
+	}
+	peer.mu.Lock()
+	duplicate := peer.version != nil
+	if !duplicate {
+		peer.version = &payload
+	}
+	peer.mu.Unlock()
+	if duplicate {
+		return misbehavior(conf.ScoreProtocolViolation, errors.New("重复发送了version消息"))
+	}
+	fmt.Printf("节点%s的版本:%d,服务:%b,客户端:%s,高度:%d\n", peer, payload.Version, payload.Services, payload.UserAgent, payload.BestHeight)
+	// 对方连进来时不知道它的节点地址，记下来以后回复消息都走这个连接
+	if payload.AddrFrom != "" {
+		n.registerPeer(peer, payload.AddrFrom)
+	}
+	// 对方连进来的，回复自己的version，然后确认对方的version
+	peer.pushVersion()
+	peer.send(conf.COMMAND_VERACK, nil)
+	if peer.checkHandshake() {
+		n.onHandshakeDone(peer)
+	}
+	return nil
+}
+
+// 处理verack消息
+func (n *Node) handleVerack(peer *Peer, data []byte) error {
+	peer.mu.Lock()
+	duplicate := peer.verackReceived
+	peer.verackReceived = true
+	peer.mu.Unlock()
+	if duplicate {
+		return misbehavior(conf.ScoreProtocolViolation, errors.New("重复发送了verack消息"))
 	}
-	// 获取本节点存的链的区块高度
-	bestHeight := bc.GetBestHeight()
-	// 节点请求发来消息的区块高度
-	foreignerBestHeight := payload.BestHeight
-	// 如果本节点的区块高度大于发来消息节点的区块高度
-	if bestHeight > foreignerBestHeight {
-		//把本节点的区块链高度信息发给对方
-		SendVersion(payload.AddrFrom, bc)
-	} else if bestHeight < foreignerBestHeight {
-		// 去向对方节点获取区块
-		SendGetBlocks(payload.AddrFrom)
+	if peer.checkHandshake() {
+		n.onHandshakeDone(peer)
 	}
-	// 如果该节点之前没来同步过，那么加入已知节点的列表
-	if !nodeIsKnown(payload.AddrFrom) {
-		KnowNodes = append(KnowNodes, payload.AddrFrom)
+	return nil
+}
+
+// 握手完成：记下对方的节点地址，对方是全节点并且链比自己高时开始同步
+// 之后的请求都通过这个连接回复，同步状态也按连接记录，不相信消息里对方自己说的地址
+func (n *Node) onHandshakeDone(peer *Peer) {
+	version := peer.remoteVersion()
+	if peer.nodeID != "" {
+		fmt.Printf("和节点%s完成了握手，节点ID:%s\n", peer, peer.nodeID)
+	} else {
+		fmt.Printf("和节点%s完成了握手，明文连接\n", peer)
 	}
+	if peer.inbound {
+		// 连进来的节点自己说的地址没有验证过，只加进地址簿，以后主动连接时才能确认
+		if version.AddrFrom != "" {
+			n.addrBook.Add(version.AddrFrom, version.Services, time.Now().Unix())
+		}
+	} else {
+		// 主动连上的节点，向它要更多的节点地址，并告诉它自己的地址
+		n.addrBook.Good(peer.String(), version.Services)
+		n.SendGetAddr(peer)
+		n.SendAddr(peer, []NetAddress{{n.address, n.localServices(), time.Now().Unix()}})
+	}
+	// 记录对方的高度，对方比自己高时先同步区块头，再下载区块
+	// 然后向对方请求交易池里的交易，正在同步时等同步完成再请求，否则交易引用的输出还不存在
+	if version.Services&conf.SERVICE_FULL_NODE != 0 {
+		n.blockSync.updatePeer(peer, version.BestHeight)
+		n.blockSync.requestMempool(peer)
+	}
+}
 
+// 处理GetAddr消息，回复地址簿里最近在线的节点
+func (n *Node) handleGetaddr(peer *Peer, data []byte) error {
+	var addrs []NetAddress
+	for _, ka := range n.addrBook.Addresses(conf.MaxAddrPerMsg) {
+		addrs = append(addrs, NetAddress{ka.Addr, ka.Services, ka.LastSeen})
+	}
+	n.SendAddr(peer, addrs)
+	return nil
 }
 
-// 处理GetBlock消息
-func handleGetblocks(request []byte, bc *pbcc.BlockChain) {
-	var buff bytes.Buffer
-	var payload GetBlocks
-	dataBytes := request[conf.COMMANDLENGTH:]
+// 处理Addr消息，把对方告诉的节点地址加入地址簿
+func (n *Node) handleAddr(peer *Peer, data []byte) error {
+	var payload Addr
 	// 反序列化
-	buff.Write(dataBytes)
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+	if len(payload.Addrs) > conf.MaxAddrPerMsg {
+		return misbehavior(conf.ScoreProtocolViolation, fmt.Errorf("发来了%d个地址，超过上限%d", len(payload.Addrs), conf.MaxAddrPerMsg))
+	}
+	for _, addr := range payload.Addrs {
+		if addr.Addr != n.address {
+			n.addrBook.Add(addr.Addr, addr.Services, addr.Timestamp)
+		}
 	}
-	//获取所有区块的hash
-	blocks := bc.GetBlockHashes()
-	//向请求地址发送Inv消息
-	SendInv(payload.AddrFrom, conf.BLOCK_TYPE, blocks)
+	fmt.Printf("收到节点%s的%d个节点地址，地址簿中有%d个地址\n", peer, len(payload.Addrs), n.addrBook.Count())
+	return nil
+}
+
+// 处理GetHeaders消息
+func (n *Node) handleGetheaders(peer *Peer, data []byte) error {
+	var payload GetHeaders
+	// 反序列化
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+	//旧格式升级上来的区块其他节点不能校验，回复空的区块头，对方就不会再向本节点同步
+	if n.legacyChain {
+		n.SendHeaders(peer, nil)
+		return nil
+	}
+	//从两条链分叉的位置开始，回复一批主链上的区块头
+	headers := n.chain.LocateHeaders(payload.Locator, payload.StopHash, conf.MaxHeadersPerMsg)
+	n.SendHeaders(peer, headers)
+	return nil
+}
+
+// 处理Headers消息
+func (n *Node) handleHeaders(peer *Peer, data []byte) error {
+	var payload Headers
+	// 反序列化
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+	if len(payload.Headers) > conf.MaxHeadersPerMsg {
+		return misbehavior(conf.ScoreProtocolViolation, fmt.Errorf("发来了%d个区块头，超过上限%d", len(payload.Headers), conf.MaxHeadersPerMsg))
+	}
+	fmt.Printf("收到节点%s的%d个区块头\n", peer, len(payload.Headers))
+	return n.blockSync.onHeaders(peer, payload.Headers)
 }
 
 // 处理Inv消息
-func handleInv(request []byte, bc *pbcc.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) handleInv(peer *Peer, data []byte) error {
 	var payload Inv
-	dataBytes := request[conf.COMMANDLENGTH:]
 	// 反序列化
-	buff.Write(dataBytes)
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+	if len(payload.Items) == 0 {
+		return misbehavior(conf.ScoreBogusRequest, errors.New("inv消息中没有数据"))
 	}
+	if len(payload.Items) > conf.MaxInvPerMsg {
+		return misbehavior(conf.ScoreProtocolViolation, fmt.Errorf("inv消息有%d个hash，超过上限%d", len(payload.Items), conf.MaxInvPerMsg))
+	}
+	// 对方通知的区块和交易不用再通知对方
+	for _, hash := range payload.Items {
+		peer.knownInventory.Add(hash)
+	}
+	switch payload.Type {
 	// 如果Inv消息的数据是Block类型
-	if payload.Type == conf.BLOCK_TYPE {
-		// 记录最新的区块hash
-		blockHash := payload.Items[0]
-		// 发送GetDate消息
-		SendGetData(payload.AddrFrom, conf.BLOCK_TYPE, blockHash)
-		// 如果携带的区块或者交易数量大于1
-		if len(payload.Items) >= 1 {
-			//存下其他剩余区块的hash
-			TransactionArray = payload.Items[1:]
+	case conf.BLOCK_TYPE:
+		// 有不认识的区块时先同步区块头，区块头校验通过后再下载区块
+		for _, hash := range payload.Items {
+			if !n.chain.HasBlock(hash) {
+				n.blockSync.onBlockInv(peer)
+				break
+			}
 		}
-	}
 	// 如果Inv消息的数据是Tx类型
-	if payload.Type == conf.TX_TYPE {
-		// 获取最后一笔交易
-		txHash := payload.Items[0]
-		// 如果缓冲交易池里面没有这个交易，则像节点发送GetData数据
-		if MemoryTxPool[hex.EncodeToString(txHash)] == nil {
-			SendGetData(payload.AddrFrom, conf.TX_TYPE, txHash)
-		}
+	case conf.TX_TYPE:
+		// 缓冲交易池里面没有的交易向节点发送GetData请求，已经在向其他节点请求的交易先不请求
+		n.txFetch.onInv(peer, payload.Items)
+	default:
+		return misbehavior(conf.ScoreBogusRequest, fmt.Errorf("inv消息的数据类型%q不认识", payload.Type))
 	}
+	return nil
 }
 
 // 处理GetData消息
-func handleGetData(request []byte, bc *pbcc.BlockChain) {
-	var buff bytes.Buffer
+// 请求的数据本节点没有时回复notfound，这不算对方的错：区块可能被回滚了，交易可能已经被打包或者过期了
+func (n *Node) handleGetData(peer *Peer, data []byte) error {
 	var payload GetData
-	dataBytes := request[conf.COMMANDLENGTH:]
 	// 反序列化
-	buff.Write(dataBytes)
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
 	}
-	if payload.Type == conf.BLOCK_TYPE {
-		// 获取区块消息
-		block, err := bc.GetBlock([]byte(payload.Hash))
-		if err != nil {
-			return
-		}
-		SendBlock(payload.AddrFrom, block)
+	if len(payload.Hash) != 32 {
+		return misbehavior(conf.ScoreBogusRequest, fmt.Errorf("getdata请求的hash长度%d不对", len(payload.Hash)))
 	}
-
-	if payload.Type == conf.TX_TYPE {
-		tx := MemoryTxPool[hex.EncodeToString(payload.Hash)]
-		SendTx(payload.AddrFrom, tx)
+	switch payload.Type {
+	case conf.BLOCK_TYPE:
+		// 获取区块消息，旧格式升级上来的节点不提供区块
+		block, err := n.chain.GetBlock(payload.Hash)
+		if err != nil || block == nil || n.legacyChain {
+			n.SendNotFound(peer, payload.Type, [][]byte{payload.Hash})
+			return nil
+		}
+		n.SendBlock(peer, block)
+	case conf.TX_TYPE:
+		tx := n.txPool.Get(payload.Hash)
+		if tx == nil {
+			n.SendNotFound(peer, payload.Type, [][]byte{payload.Hash})
+			return nil
+		}
+		peer.knownInventory.Add(payload.Hash)
+		n.SendTx(peer, tx)
+	default:
+		return misbehavior(conf.ScoreBogusRequest, fmt.Errorf("getdata请求的数据类型%q不认识", payload.Type))
 	}
+	return nil
 }
 
 // 处理发送区块消息
-func handleBlock(request []byte, bc *pbcc.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) handleBlock(peer *Peer, data []byte) error {
 	var payload BlockData
-	dataBytes := request[conf.COMMANDLENGTH:]
 	// 反序列化
-	buff.Write(dataBytes)
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
 	}
 	blockBytes := payload.Block
-	// 解析获取区块
-	block := pbcc.DeserializeBlock(blockBytes)
+	// 解析获取区块，其他节点发来的数据可能不合法，不能直接panic
+	block, err := pbcc.DecodeBlock(blockBytes)
+	if err != nil {
+		return misbehavior(conf.ScoreMalformedMessage, fmt.Errorf("区块数据解析失败: %v", err))
+	}
 	fmt.Println("Recevied a new block!")
-	// 新的区块加入链上
-	bc.AddBlock(block)
-	fmt.Printf("Added block %x\n", block.Hash)
-	// 如果还有区块
-	if len(TransactionArray) > 0 {
-		blockHash := TransactionArray[0]
-		// 再去请求
-		SendGetData(payload.AddrFrom, "block", blockHash)
-		// 更新未打包进区块链的区块池
-		TransactionArray = TransactionArray[1:]
-	} else {
-		fmt.Println("已经没有要处理的区块了")
+	peer.knownInventory.Add(block.Hash)
+	// 同步时请求的区块交给同步管理按高度顺序接入
+	if n.blockSync.onBlock(peer, block) {
+		return nil
 	}
+	// 其他节点直接发来的区块，校验通过的区块才加入链上，不合法的区块直接丢弃
+	change, err := n.processBlock(block)
+	if change != nil {
+		n.broadcastInv(conf.BLOCK_TYPE, [][]byte{block.Hash}, peer)
+	}
+	if err != nil {
+		// 缺少前面的区块，先同步区块头
+		if errors.Is(err, pbcc.ErrPrevBlockNotFound) {
+			n.blockSync.onBlockInv(peer)
+		}
+		return misbehavior(blockScore(err), fmt.Errorf("拒绝区块 %x: %w", block.Hash, err))
+	}
+	return nil
 }
 
 // 处理发送交易消息
-func handleTx(request []byte, bc *pbcc.BlockChain) {
-	var buff bytes.Buffer
+func (n *Node) handleTx(peer *Peer, data []byte) error {
 	var payload Tx
-	dataBytes := request[conf.COMMANDLENGTH:]
 	// 反序列化
-	buff.Write(dataBytes)
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+	tx, err := pbcc.DecodeTransaction(payload.Tx)
 	if err != nil {
-		log.Panic(err)
-	}
-	tx := payload.Tx
-	// 交易存到交易缓冲池子
-	MemoryTxPool[hex.EncodeToString(tx.TxID)] = tx
-	// 说明主节点自己
-	if NodeAddress == KnowNodes[0] {
-		// 给矿工节点发送交易hash
-		for _, nodeAddr := range KnowNodes {
-			if nodeAddr != NodeAddress && nodeAddr != payload.AddrFrom {
-				SendInv("localhost:8002", conf.TX_TYPE, [][]byte{tx.TxID})
-			}
-		}
+		return misbehavior(conf.ScoreMalformedMessage, fmt.Errorf("交易数据解析失败: %v", err))
 	}
-	// 矿工进行挖矿验证
-	if len(MemoryTxPool) >= 1 && len(MinerAddress) > 0 {
-	MineTransactions:
-		utxoSet := &pbcc.UTXOSet{bc}
-		txs := []*pbcc.Transaction{tx}
-		//奖励
-		coinbaseTx := pbcc.NewCoinBaseTransaction(MinerAddress)
-		txs = append(txs, coinbaseTx)
-		_txs := []*pbcc.Transaction{}
-		for _, tx := range txs {
-			// 数字签名失败
-			if bc.VerifyTransaction(tx, _txs) != true {
-				log.Panic("ERROR: Invalid transaction")
-			}
-			_txs = append(_txs, tx)
-		}
-		//通过相关算法建立Transaction数组
-		var block *pbcc.Block
-		bc.DB.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
-			if b != nil {
-				hash := b.Get([]byte("l"))
-				blockBytes := b.Get(hash)
-				block = pbcc.DeserializeBlock(blockBytes)
-			}
-			return nil
-		})
-		//建立新的区块
-		block = pbcc.NewBlock(txs, block.Hash, block.Height+1)
-		//将新区块存储到数据库
-		bc.DB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(conf.BLOCKTABLENAME))
-			if b != nil {
-				b.Put(block.Hash, block.Serilalize())
-				b.Put([]byte("l"), block.Hash)
-				bc.Tip = block.Hash
-			}
-			return nil
-		})
-		utxoSet.Update()
-		SendBlock(KnowNodes[0], block.Serilalize())
-		for _, tx := range txs {
-			txID := hex.EncodeToString(tx.TxID)
-			delete(MemoryTxPool, txID)
-		}
-		for _, node := range KnowNodes {
-			if node != NodeAddress {
-				SendInv(node, "block", [][]byte{block.Hash})
-			}
+	peer.knownInventory.Add(tx.TxID)
+	n.txFetch.onTx(tx.TxID)
+	// 交易校验通过后存到交易缓冲池子，不合法的交易不再转发
+	if err := n.acceptTransaction(tx, peer); err != nil {
+		return misbehavior(txScore(err), fmt.Errorf("拒绝交易 %x: %w", tx.TxID, err))
+	}
+	return nil
+}
+
+// 提交一笔本地的交易：校验通过后放进交易池，然后通知所有连接的节点
+func (n *Node) SubmitTransaction(tx *pbcc.Transaction) error {
+	return n.acceptTransaction(tx, nil)
+}
+
+// 交易放进交易池并转发，from是发来交易的节点，本地提交的交易为nil
+func (n *Node) acceptTransaction(tx *pbcc.Transaction, from *Peer) error {
+	if err := n.txPool.Add(tx); err != nil {
+		return err
+	}
+	n.markTxPoolDirty()
+	// 把交易hash转发给其他所有节点，不再发回给发来交易的节点
+	n.broadcastInv(conf.TX_TYPE, [][]byte{tx.TxID}, from)
+	// 矿工节点：收到新交易后重新开始挖矿，把新交易也打包进去
+	if len(n.minerAddress) > 0 {
+		n.restartMining()
+	}
+	return nil
+}
+
+// 处理NotFound消息，请求的区块或交易对方没有，换一个节点请求
+func (n *Node) handleNotFound(peer *Peer, data []byte) error {
+	var payload NotFound
+	// 反序列化
+	if err := decodePayload(data, &payload); err != nil {
+		return err
+	}
+	if len(payload.Items) > conf.MaxInvPerMsg {
+		return misbehavior(conf.ScoreProtocolViolation, fmt.Errorf("notfound消息有%d个hash，超过上限%d", len(payload.Items), conf.MaxInvPerMsg))
+	}
+	switch payload.Type {
+	case conf.BLOCK_TYPE:
+		n.blockSync.onNotFound(peer, payload.Items)
+	case conf.TX_TYPE:
+		n.txFetch.onNotFound(peer, payload.Items)
+	default:
+		return misbehavior(conf.ScoreBogusRequest, fmt.Errorf("notfound消息的数据类型%q不认识", payload.Type))
+	}
+	return nil
+}
+
+// 处理MemPool消息，用inv通知对方交易池里它还不知道的交易，父交易在前面
+func (n *Node) handleMempool(peer *Peer, data []byte) error {
+	var hashes [][]byte
+	for _, tx := range n.txPool.Transactions() {
+		if peer.knownInventory.Has(tx.TxID) {
+			continue
 		}
-		if len(MemoryTxPool) > 0 {
-			goto MineTransactions
+		peer.knownInventory.Add(tx.TxID)
+		hashes = append(hashes, tx.TxID)
+		if len(hashes) == conf.MaxInvPerMsg {
+			peer.pushInv(conf.TX_TYPE, hashes)
+			hashes = nil
 		}
 	}
+	if len(hashes) > 0 {
+		peer.pushInv(conf.TX_TYPE, hashes)
+	}
+	fmt.Printf("节点%s请求了交易池，交易池中有%d笔交易\n", peer, n.txPool.Count())
+	return nil
 }
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"math/big"
+	"net"
+	"publicchain/conf"
+	"publicchain/mempool"
+	"publicchain/pbcc"
+	"time"
+)
+
+// 节点使用的区块链，*pbcc.BlockChain实现了这个接口
+type Chain interface {
+	GetBestHeight() int64
+	GetTipHash() []byte
+	GetTipBlock() *pbcc.Block
+	HasBlock(blockHash []byte) bool
+	GetBlock(blockHash []byte) ([]byte, error)
+	GetBlockHashByHeight(height int64) ([]byte, error)
+	FindTransaction(txID []byte) (*pbcc.Transaction, []byte)
+	FindUnspentOutputs(address string) []*pbcc.UTXO
+	GetHeader(blockHash []byte) (*pbcc.BlockHeader, error)
+	AddBlock(block *pbcc.Block) (*pbcc.TipChange, error)
+	AddHeader(header *pbcc.BlockHeader) ([]byte, error)
+	BlockLocator(blockHash []byte) [][]byte
+	LocateHeaders(locator [][]byte, stopHash []byte, max int) []*pbcc.BlockHeader
+	CalcNextBits(parent *pbcc.BlockHeader) (uint32, error)
+	GetChainWork(blockHash []byte) (*big.Int, error)
+	IsLegacyChain() bool
+	Close() error
+}
+
+// 节点使用的交易池，*mempool.TxPool实现了这个接口
+type Mempool interface {
+	Add(tx *pbcc.Transaction) error
+	Get(txID []byte) *pbcc.Transaction
+	Has(txID []byte) bool
+	Count() int
+	Transactions() []*pbcc.Transaction
+	TxDescs() []*mempool.TxDesc
+	NewBlockTemplate(maxSize int) *mempool.BlockTemplate
+	ProcessTipChange(change *pbcc.TipChange)
+	Save() error
+}
+
+// 节点之间的连接方式，默认是TCP，测试时可以换成进程内的连接
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// 使用TCP连接
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(conf.PROTOCOL, addr)
+}
+
+func (tcpTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(conf.PROTOCOL, addr, timeout)
+}
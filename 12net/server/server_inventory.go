@@ -0,0 +1,95 @@
+package server
+
+import (
+	"publicchain/conf"
+	"sync"
+	"time"
+)
+
+// 有上限的hash集合，记录对方已经知道的区块和交易，超过上限时删掉最早加入的
+type inventorySet struct {
+	mu    sync.Mutex
+	items map[string]bool
+	order []string // 加入的顺序
+	limit int
+}
+
+func newInventorySet(limit int) *inventorySet {
+	return &inventorySet{items: make(map[string]bool), limit: limit}
+}
+
+func (set *inventorySet) Add(hash []byte) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	key := string(hash)
+	if set.items[key] {
+		return
+	}
+	set.items[key] = true
+	set.order = append(set.order, key)
+	if len(set.order) > set.limit {
+		delete(set.items, set.order[0])
+		set.order = set.order[1:]
+	}
+}
+
+func (set *inventorySet) Has(hash []byte) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.items[string(hash)]
+}
+
+// 把交易放进等待通知的队列，对方已经知道的交易不再通知
+func (p *Peer) queueInv(hash []byte) {
+	if p.knownInventory.Has(hash) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.invQueue) < conf.MaxKnownInventory {
+		p.invQueue = append(p.invQueue, hash)
+	}
+}
+
+// 定时把队列里的交易合并成inv消息发给对方，不用每收到一笔交易就发一条消息
+// 间隔一段时间再通知，也让别人不容易根据通知的先后猜出交易最早是哪个节点发出的
+func (p *Peer) trickleLoop() {
+	ticker := time.NewTicker(conf.TrickleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.flushInv()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *Peer) flushInv() {
+	p.mu.Lock()
+	queue := p.invQueue
+	p.invQueue = nil
+	p.mu.Unlock()
+	var hashes [][]byte
+	for _, hash := range queue {
+		if p.knownInventory.Has(hash) {
+			continue
+		}
+		p.knownInventory.Add(hash)
+		hashes = append(hashes, hash)
+		if len(hashes) == conf.MaxInvPerMsg {
+			p.pushInv(conf.TX_TYPE, hashes)
+			hashes = nil
+		}
+	}
+	if len(hashes) > 0 {
+		p.pushInv(conf.TX_TYPE, hashes)
+	}
+}
+
+// 直接通过这个连接发送inv消息
+func (p *Peer) pushInv(kind string, hashes [][]byte) {
+	payload := encodePayload(&Inv{kind, hashes})
+	p.send(conf.COMMAND_INV, payload)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"publicchain/conf"
+	"publicchain/utils"
+)
+
+/*
+	节点之间的消息格式，每条消息由消息头和消息体组成：
+		1.网络标识 4个字节，不同网络的节点连上了可以马上发现
+		2.消息类型 12个字节，和CommandToBytes的格式一样
+		3.消息体的长度 4个字节，大端字节序
+		4.校验和 4个字节，消息体两次sha256的前4个字节
+		5.消息体
+*/
+
+// 消息头的长度
+const messageHeaderLength = 4 + conf.COMMANDLENGTH + 4 + 4
+
+// 消息格式不对的错误类型
+var (
+	ErrBadMagic        = errors.New("消息的网络标识不对")
+	ErrMessageTooLarge = errors.New("消息超过大小上限")
+	ErrBadChecksum     = errors.New("消息的校验和不对")
+)
+
+// 计算消息体的校验和
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// 把一条消息写到连接里
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	if len(payload) > conf.MaxMessageSize {
+		return fmt.Errorf("%w: %s消息有%d个字节", ErrMessageTooLarge, command, len(payload))
+	}
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, conf.NetworkMagic)
+	header.Write(utils.CommandToBytes(command))
+	binary.Write(&header, binary.BigEndian, uint32(len(payload)))
+	header.Write(messageChecksum(payload))
+	if _, err := w.Write(append(header.Bytes(), payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 从连接里读出一条消息，先读消息头，长度合法才分配内存读消息体
+func readMessage(r io.Reader) (string, []byte, error) {
+	var header [messageHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, err
+	}
+	if magic := binary.BigEndian.Uint32(header[:4]); magic != conf.NetworkMagic {
+		return "", nil, fmt.Errorf("%w: %08x", ErrBadMagic, magic)
+	}
+	command := utils.BytesToCommand(header[4 : 4+conf.COMMANDLENGTH])
+	length := binary.BigEndian.Uint32(header[4+conf.COMMANDLENGTH:])
+	if length > conf.MaxMessageSize {
+		return "", nil, fmt.Errorf("%w: %s消息有%d个字节", ErrMessageTooLarge, command, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(messageChecksum(payload), header[messageHeaderLength-4:]) {
+		return "", nil, fmt.Errorf("%w: %s消息", ErrBadChecksum, command)
+	}
+	return command, payload, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"publicchain/conf"
+	"publicchain/mempool"
+	"publicchain/pbcc"
+)
+
+// 重新开始挖矿：停止正在进行的挖矿，用最新的tip和交易池里的交易重新开始
+// 收到新交易或者主链tip发生变化时调用，避免在旧的tip上继续浪费算力
+// 节点正在停止时不再开始挖矿
+func (n *Node) restartMining() {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+	if n.miningStopped {
+		return
+	}
+	if n.miningCancel != nil {
+		n.miningCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n.miningCancel = cancel
+	n.goTracked(func() { n.mineTransactions(ctx) })
+}
+
+// 节点停止时取消正在进行的挖矿，之后不再开始挖矿
+func (n *Node) stopMining() {
+	n.miningLock.Lock()
+	defer n.miningLock.Unlock()
+	n.miningStopped = true
+	if n.miningCancel != nil {
+		n.miningCancel()
+	}
+}
+
+// 把交易池里的交易打包挖矿，直到交易池空了或者被取消
+func (n *Node) mineTransactions(ctx context.Context) {
+	for ctx.Err() == nil && n.txPool.Count() > 0 {
+		//按费率挑选交易池里的交易，交易在进入交易池时已经校验过
+		template := n.txPool.NewBlockTemplate(conf.MaxBlockSize - conf.CoinbaseReserveSize)
+		if len(template.Txs) == 0 {
+			return
+		}
+		if _, err := n.mineBlock(ctx, n.minerAddress, template); err != nil {
+			fmt.Println("停止挖矿:", err)
+			return
+		}
+	}
+}
+
+// 立即挖一个区块，奖励给address，交易池里的交易也打包进去，交易池是空的时候只有coinbase交易
+// 没有设置矿工地址的节点也可以调用，测试时用来控制哪个节点在什么时候挖出区块
+func (n *Node) GenerateBlock(ctx context.Context, address string) (*pbcc.Block, error) {
+	template := n.txPool.NewBlockTemplate(conf.MaxBlockSize - conf.CoinbaseReserveSize)
+	return n.mineBlock(ctx, address, template)
+}
+
+// 在当前的tip上用模板里的交易挖一个区块，挖出后加入区块链并通知其他节点
+func (n *Node) mineBlock(ctx context.Context, address string, template *mempool.BlockTemplate) (*pbcc.Block, error) {
+	bc := n.chain
+	tip := bc.GetTipBlock()
+	//奖励加上手续费，coinbase交易必须是区块的第一笔交易
+	coinbase := pbcc.NewCoinBaseTransaction(address, tip.Height+1, template.Fees)
+	txs := append([]*pbcc.Transaction{coinbase}, template.Txs...)
+	bits, err := bc.CalcNextBits(&tip.BlockHeader)
+	if err != nil {
+		return nil, fmt.Errorf("计算难度失败: %w", err)
+	}
+	//建立新的区块
+	opts := pbcc.MiningOptions{Workers: n.config.MiningWorkers, Progress: printMiningProgress, Now: n.config.MiningClock}
+	block, err := pbcc.MineBlock(ctx, txs, tip.Hash, tip.Height+1, bits, opts)
+	if err != nil {
+		return nil, err
+	}
+	//将新区块存储到数据库，同时更新UTXO表
+	change, err := bc.AddBlock(block)
+	if err != nil {
+		return nil, fmt.Errorf("新挖出的区块无效: %w", err)
+	}
+	n.txPool.ProcessTipChange(change)
+	n.markTxPoolDirty()
+	fmt.Printf("挖出新区块 %x\n", block.Hash)
+	// 通知所有节点，它们会先同步区块头再下载区块
+	n.broadcastInv(conf.BLOCK_TYPE, [][]byte{block.Hash}, nil)
+	return block, nil
+}
+
+// 打印挖矿进度
+func printMiningProgress(stats pbcc.MiningStats) {
+	fmt.Printf("挖矿中: 已计算%d次hash, %.0f hash/s\n", stats.Hashes, stats.HashRate)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"publicchain/conf"
+	"publicchain/mempool"
+	"publicchain/pbcc"
+)
+
+// 对方违反协议的错误，Score是要给对方增加的行为不当分数
+type misbehaviorError struct {
+	Score int
+	Err   error
+}
+
+func (e *misbehaviorError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *misbehaviorError) Unwrap() error {
+	return e.Err
+}
+
+// 创建一个违反协议的错误，分数为0时就是普通的错误
+func misbehavior(score int, err error) error {
+	if score <= 0 {
+		return err
+	}
+	return &misbehaviorError{score, err}
+}
+
+// 给节点增加行为不当的分数，达到conf.BanThreshold就断开连接并封禁
+// 还不知道节点地址的连接只断开不封禁，连接的端口每次都不一样，封禁了也没有用
+func (p *Peer) misbehaving(score int, reason string) {
+	if score <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.score += score
+	total := p.score
+	p.mu.Unlock()
+	fmt.Printf("节点%s行为不当(%s)，分数增加%d，现在是%d\n", p, reason, score, total)
+	if total < conf.BanThreshold {
+		return
+	}
+	n := p.node
+	n.peersLock.Lock()
+	addr := p.addr
+	n.peersLock.Unlock()
+	if addr != "" {
+		n.banList.Ban(addr, conf.BanDuration, reason)
+		if err := n.banList.Save(); err != nil {
+			fmt.Println("保存封禁列表失败:", err)
+		}
+		fmt.Printf("封禁节点%s，时长%v\n", addr, conf.BanDuration)
+	}
+	p.disconnect()
+}
+
+// 区块被拒绝时对方应得的分数：缺少前面的区块或者数据库出错不是对方的问题
+func blockScore(err error) int {
+	var validationErr *pbcc.ValidationError
+	if !errors.As(err, &validationErr) || errors.Is(err, pbcc.ErrPrevBlockNotFound) {
+		return 0
+	}
+	return conf.ScoreInvalidBlock
+}
+
+// 区块头被拒绝时对方应得的分数
+func headerScore(err error) int {
+	if blockScore(err) == 0 {
+		return 0
+	}
+	return conf.ScoreInvalidHeader
+}
+
+// 交易被交易池拒绝时对方应得的分数
+// 交易已经有了、输入已经被花费、交易池满了这些情况，诚实的节点因为同步的先后也会遇到，不算违反协议
+func txScore(err error) int {
+	switch {
+	case errors.Is(err, mempool.ErrTxExists),
+		errors.Is(err, mempool.ErrDoubleSpend),
+		errors.Is(err, mempool.ErrMissingInputs),
+		errors.Is(err, mempool.ErrImmatureSpend),
+		errors.Is(err, mempool.ErrPoolFull):
+		return 0
+	}
+	return conf.ScoreInvalidTx
+}
@@ -1,41 +1,63 @@
 package server
 
-import "publicchain/pbcc"
-
-//version消息结构体
+//version消息结构体 连接建立后双方先交换version消息，握手完成前不处理其他消息
 type Version struct {
-	Version    int64  // 版本
+	Version    int64  // 协议版本
+	Services   uint64 // 服务标志，conf.SERVICE_*的组合
+	Timestamp  int64  // 发送时的时间
+	Nonce      uint64 // 随机数，收到自己发出的随机数说明连上了自己
+	UserAgent  string // 客户端名称和版本
 	BestHeight int64  // 当前节点区块的高度
-	AddrFrom   string //当前节点的地址
+	AddrFrom   string //当前节点的地址，不监听端口的客户端为空
+}
+
+//请求区块头 对方从定位器里找到两条链分叉的位置，回复后面的区块头
+type GetHeaders struct {
+	Locator  [][]byte //区块定位器，从新到旧的区块hash
+	StopHash []byte   //最后一个需要的区块hash，为空时尽量多回复
+}
+
+//Headers消息结构体 回复GetHeaders请求，区块头按高度从低到高排列
+type Headers struct {
+	Headers [][]byte //区块头的二进制编码
 }
 
-//请求区块信息结构 意为 “给我看一下你有什么区块”（在比特币中，这会更加复杂）
-type GetBlocks struct {
-	AddrFrom string //对方的节点地址
+//addr消息里的一个节点地址
+type NetAddress struct {
+	Addr      string // 节点监听的地址
+	Services  uint64 // 节点提供的服务
+	Timestamp int64  // 最后一次知道这个节点在线的时间
+}
+
+//Addr消息结构体 回复GetAddr，或者握手后告诉对方自己的地址
+type Addr struct {
+	Addrs []NetAddress
 }
 
 // Inv消息结构体 像别人展示自己的区块或者交易的信息
 type Inv struct {
-	AddrFrom string   //自己的地址
-	Type     string   //类型 block tx
-	Items    [][]byte //hash二维数组
+	Type  string   //类型 block tx
+	Items [][]byte //hash二维数组
 }
 
 // GetData消息结构体  用于某个块或交易的请求，它可以仅包含一个块或交易的ID。
 type GetData struct {
-	AddrFrom string
-	Type     string
-	Hash     []byte //获取的是hash
+	Type string
+	Hash []byte //获取的是hash
+}
+
+// NotFound消息结构体 回复GetData请求的数据本节点没有，对方可以向其他节点请求
+type NotFound struct {
+	Type  string
+	Items [][]byte
 }
 
 // BlockData消息结构体 给发送GetData请求回复区块
 type BlockData struct {
-	AddrFrom string
-	Block    []byte
+	Block []byte
 }
 
 // Tx消息结构体 给发送GetData请求回复交易
 type Tx struct {
-	AddrFrom string
-	Tx       *pbcc.Transaction
+	Tx []byte //交易的二进制编码
 }
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"publicchain/addrbook"
+	"publicchain/conf"
+	"publicchain/crypto"
+	"publicchain/mempool"
+	"publicchain/pbcc"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 创建节点的参数
+// Chain、Mempool、Transport、NodeKey、AddrBook和BanList为空时使用默认的实现：打开NodeID对应的数据库，
+// 加载上次保存的交易池，使用TCP连接，从文件加载节点的身份密钥、地址簿和封禁列表
+type Config struct {
+	NodeID            string
+	Address           string   // 节点地址，为空时是localhost:NodeID
+	MinerAddress      string   // 旷工地址，为空时不挖矿
+	Seeds             []string // 种子节点的地址，第一次启动时从种子节点获取其他节点的地址
+	RequireEncryption bool     // 为true时只接受加密连接
+	RPCAddress        string   // JSON-RPC服务的地址，为空时不启动RPC服务
+
+	MiningWorkers int              // 挖矿的goroutine数量，为0时使用CPU核数
+	MiningClock   func() time.Time // 挖出的区块的时间戳从这里取，为nil时使用当前时间
+
+	Chain     Chain
+	Mempool   Mempool
+	Transport Transport
+	NodeKey   *crypto.NodeKey
+	AddrBook  *addrbook.AddrBook
+	BanList   *addrbook.BanList
+}
+
+// 一个节点：拥有监听端口、区块链、交易池、区块同步和挖矿，节点的所有状态都在这里
+// 一个进程里可以运行多个节点，消息处理函数都是Node的方法
+// Start启动节点，调用Stop或者Start的ctx取消时停止：停止RPC服务，不再接受连接，取消挖矿，断开所有连接，
+// 等正在处理的消息处理完，然后保存交易池、地址簿和封禁列表，最后关闭区块链
+type Node struct {
+	config       Config
+	address      string          //节点地址
+	minerAddress string          //旷工地址
+	chain        Chain           //本节点的区块链
+	legacyChain  bool            //区块链是旧格式数据库升级上来的，其他节点不能校验，不提供区块
+	txPool       Mempool         //交易池存储交易
+	txPoolDirty  int32           //交易池变化以后还没有保存，用atomic读写
+	transport    Transport       //建立连接的方式
+	nodeKey      *crypto.NodeKey //本节点的身份密钥，节点ID由它的公钥计算
+	nonce        uint64          //本节点version消息里的随机数，用来发现连上了自己
+	blockSync    *syncManager    //区块同步管理
+	txFetch      *txFetcher      //交易下载管理
+	addrBook     *addrbook.AddrBook
+	banList      *addrbook.BanList
+
+	miningLock    sync.Mutex         //保护miningCancel和miningStopped
+	miningCancel  context.CancelFunc //取消正在进行的挖矿
+	miningStopped bool               //节点正在停止，不再开始挖矿
+
+	peersLock   sync.Mutex
+	peers       map[string]*Peer // 已经建立连接的节点，key是节点地址
+	livePeers   map[*Peer]bool   // 所有连接，包括还不知道节点地址的连进来的连接，节点停止时全部断开
+	peersClosed bool             // 节点正在停止，不再登记新的连接
+
+	listener     net.Listener
+	rpcServer    *http.Server   // JSON-RPC服务，没有启动时为nil
+	rpcCookie    string         // RPC请求的密码
+	wg           sync.WaitGroup // 后台goroutine和连接的读写goroutine，节点停止时等它们结束
+	inboundSlots chan struct{}  // 连进来的连接数量限制，每个连接占一个位置
+	cancel       context.CancelFunc
+	stopOnce     sync.Once
+	done         chan struct{} // 节点完全停止后关闭
+}
+
+func NewNode(config Config) *Node {
+	address := config.Address
+	if address == "" {
+		address = fmt.Sprintf("localhost:%s", config.NodeID)
+	}
+	transport := config.Transport
+	if transport == nil {
+		transport = tcpTransport{}
+	}
+	return &Node{
+		config:       config,
+		address:      address,
+		minerAddress: config.MinerAddress,
+		transport:    transport,
+		nonce:        randomNonce(),
+		peers:        make(map[string]*Peer),
+		livePeers:    make(map[*Peer]bool),
+		inboundSlots: make(chan struct{}, conf.MaxInboundPeers),
+		done:         make(chan struct{}),
+	}
+}
+
+// 节点地址
+func (n *Node) Address() string {
+	return n.address
+}
+
+// 本节点的区块链，Start之后才有
+func (n *Node) Chain() Chain {
+	return n.chain
+}
+
+// 本节点的交易池，Start之后才有
+func (n *Node) Mempool() Mempool {
+	return n.txPool
+}
+
+// 主动连接一个节点，已经连接时什么也不做，握手在后台进行
+func (n *Node) Connect(addr string) error {
+	_, err := n.connectPeer(addr)
+	return err
+}
+
+// 握手完成的节点地址
+func (n *Node) Peers() []string {
+	var addrs []string
+	for _, p := range n.connectedPeerList() {
+		if p.isHandshakeDone() {
+			addrs = append(addrs, p.String())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// 启动节点：监听端口，加载区块链、交易池和地址簿，启动后台任务，然后立即返回
+// ctx取消时节点自动停止，用Done等待节点停止
+func (n *Node) Start(ctx context.Context) error {
+	fmt.Printf("nodeAddress:%s,minerAddress:%s\n", n.address, n.minerAddress)
+	// 监听其他节点的连接，所有节点的地位都一样，设置了矿工地址的节点会挖矿
+	ln, err := n.transport.Listen(n.address)
+	if err != nil {
+		return err
+	}
+	if err := n.load(); err != nil {
+		ln.Close()
+		return err
+	}
+	n.listener = ln
+	fmt.Printf("本节点的ID是:%s\n", n.nodeKey.ID())
+	n.blockSync = newSyncManager(n)
+	n.txFetch = newTxFetcher(n)
+	// 种子节点加进地址簿，然后由连接管理主动连接地址簿里的节点
+	for _, seed := range n.config.Seeds {
+		if seed != n.address {
+			n.addrBook.Add(seed, 0, 0)
+		}
+	}
+
+	ctx, n.cancel = context.WithCancel(ctx)
+	n.goTracked(func() { n.blockSync.run(ctx) })
+	n.goTracked(func() { n.txFetch.run(ctx) })
+	n.goTracked(func() { n.connectionManager(ctx) })
+	n.goTracked(n.acceptLoop)
+	n.goTracked(func() { n.saveTxPoolLoop(ctx) })
+	go func() {
+		<-ctx.Done()
+		n.Stop()
+	}()
+	// 节点的其他部分都启动以后才接受RPC请求
+	if n.config.RPCAddress != "" {
+		if err := n.startRPC(n.config.RPCAddress); err != nil {
+			n.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// 准备节点的身份密钥、区块链、交易池、地址簿和封禁列表，没有注入的就用默认的实现
+func (n *Node) load() error {
+	// 加载节点的身份密钥，和其他节点加密握手时使用
+	n.nodeKey = n.config.NodeKey
+	if n.nodeKey == nil {
+		key, err := crypto.LoadNodeKey(fmt.Sprintf(conf.NodeKeyFile, n.config.NodeID))
+		if err != nil {
+			return err
+		}
+		n.nodeKey = key
+	}
+	n.chain = n.config.Chain
+	if n.chain == nil {
+		bc := pbcc.GetBlockchainObject(n.config.NodeID)
+		if bc == nil {
+			return errors.New("数据库不存在，请先创建区块链")
+		}
+		// 检查UTXO表和主链是否一致，不一致时根据撤销数据恢复
+		utxoSet := &pbcc.UTXOSet{BlockChain: bc}
+		if err := utxoSet.Recover(); err != nil {
+			bc.Close()
+			return err
+		}
+		n.chain = bc
+	}
+	n.legacyChain = n.chain.IsLegacyChain()
+	if n.legacyChain {
+		fmt.Println("区块链是旧格式数据库升级上来的，其他节点不能校验这些区块，本节点不提供区块下载")
+	}
+	n.txPool = n.config.Mempool
+	if n.txPool == nil {
+		// 默认的交易池要通过UTXO表校验交易，只能和默认的区块链一起使用
+		bc, ok := n.chain.(*pbcc.BlockChain)
+		if !ok {
+			n.chain.Close()
+			return errors.New("使用自定义的区块链时必须同时提供交易池")
+		}
+		// 加载上次保存的交易池
+		n.txPool = mempool.Load(bc, n.config.NodeID)
+	}
+	// 加载地址簿和封禁列表
+	n.addrBook = n.config.AddrBook
+	if n.addrBook == nil {
+		n.addrBook = addrbook.Load(n.config.NodeID)
+	}
+	n.banList = n.config.BanList
+	if n.banList == nil {
+		n.banList = addrbook.LoadBanList(n.config.NodeID)
+	}
+	return nil
+}
+
+// 停止节点，等到节点完全停止才返回，可以重复调用
+// 只能在Start成功之后调用
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		fmt.Println("正在停止节点...")
+		n.cancel()
+		n.stopRPC()
+		n.listener.Close()
+		n.stopMining()
+		n.closePeers()
+		// 等正在处理的消息处理完，之后不会再有goroutine访问区块链
+		n.wg.Wait()
+		n.saveMemoryTxPool()
+		if err := n.addrBook.Save(); err != nil {
+			fmt.Println("保存地址簿失败:", err)
+		}
+		if err := n.banList.Save(); err != nil {
+			fmt.Println("保存封禁列表失败:", err)
+		}
+		if err := n.chain.Close(); err != nil {
+			fmt.Println("关闭数据库失败:", err)
+		}
+		fmt.Println("节点已停止")
+		close(n.done)
+	})
+}
+
+// 节点完全停止后关闭的channel
+func (n *Node) Done() <-chan struct{} {
+	return n.done
+}
+
+// 在新的goroutine里运行f，节点停止时等它结束
+func (n *Node) goTracked(f func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+}
+
+// 接受其他节点的连接，监听端口关闭后返回
+// 连进来的连接数量达到conf.MaxInboundPeers时直接关闭新的连接
+func (n *Node) acceptLoop() {
+	for {
+		// 其他节点连进来，建立长连接，消息的格式见server_message.go
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("接受连接失败:", err)
+			time.Sleep(conf.AcceptRetryDelay)
+			continue
+		}
+		select {
+		case n.inboundSlots <- struct{}{}:
+		default:
+			fmt.Printf("连进来的连接已经达到%d个，拒绝%s\n", conf.MaxInboundPeers, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		// 每个连接先加密握手，然后单独的goroutine读写消息
+		n.goTracked(func() {
+			defer func() { <-n.inboundSlots }()
+			n.acceptPeer(conn)
+		})
+	}
+}
+
+// 交易池变了，等下一次定时保存或者节点停止时写到文件
+func (n *Node) markTxPoolDirty() {
+	atomic.StoreInt32(&n.txPoolDirty, 1)
+}
+
+// 定时保存交易池，每个交易和区块都重写整个文件太慢
+func (n *Node) saveTxPoolLoop(ctx context.Context) {
+	ticker := time.NewTicker(conf.MempoolSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.saveMemoryTxPool()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 交易池变过时把它保存到文件，节点重启后可以恢复，保存失败下次再试
+func (n *Node) saveMemoryTxPool() {
+	if !atomic.CompareAndSwapInt32(&n.txPoolDirty, 1, 0) {
+		return
+	}
+	if err := n.txPool.Save(); err != nil {
+		n.markTxPoolDirty()
+		fmt.Println("保存交易池失败:", err)
+	}
+}
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"publicchain/conf"
+	"sync"
+	"time"
+)
+
+// 要发送的一条消息
+type outMessage struct {
+	command string
+	payload []byte
+}
+
+// 和另一个节点之间的长连接，一个goroutine读消息，一个goroutine写消息
+// 任何一边出错都会断开连接，断开后从节点列表里删除
+// 连接建立后先握手：双方互相发送version，收到对方的version后回复verack，双方都收到verack以后才处理其他消息
+type Peer struct {
+	node      *Node
+	addr      string // 对方监听的节点地址，对方连进来时收到version消息后才知道
+	nodeID    string // 对方的节点ID，由加密握手时对方的身份公钥计算，明文连接为空
+	conn      net.Conn
+	inbound   bool // 是否是对方连进来的
+	sendQueue chan outMessage
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	mu             sync.Mutex
+	version        *Version     // 对方发来的version消息，还没收到时为nil
+	versionSent    bool         // 是否已经发送了自己的version消息
+	verackReceived bool         // 是否收到了对方的verack
+	handshakeDone  bool         // 握手是否完成
+	pending        []outMessage // 握手完成前要发送的其他消息
+	score          int          // 行为不当的分数，见misbehaving
+	invQueue       [][]byte     // 等待通知对方的交易，见trickleLoop
+	handshakeTimer *time.Timer  // 握手超时的计时器，握手完成或者断开连接时停止，停止后为nil
+
+	knownInventory *inventorySet // 对方已经知道的区块和交易，不再通知对方
+}
+
+// 要连接的节点已经被封禁
+var ErrPeerBanned = errors.New("节点已经被封禁")
+
+// 主动连接的节点数量已经达到conf.MaxOutboundPeers
+var ErrTooManyPeers = errors.New("主动连接的节点太多")
+
+// 节点正在停止，不再建立新的连接
+var ErrNodeStopped = errors.New("节点已经停止")
+
+func newPeer(node *Node, conn net.Conn, addr string, inbound bool, nodeID string) *Peer {
+	return &Peer{
+		node:      node,
+		addr:      addr,
+		nodeID:    nodeID,
+		conn:      conn,
+		inbound:   inbound,
+		sendQueue: make(chan outMessage, conf.MaxSendQueue),
+		quit:      make(chan struct{}),
+
+		knownInventory: newInventorySet(conf.MaxKnownInventory),
+	}
+}
+
+// 对方的地址，还不知道节点地址时用连接的地址
+func (p *Peer) String() string {
+	p.node.peersLock.Lock()
+	defer p.node.peersLock.Unlock()
+	if p.addr != "" {
+		return p.addr
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+// 登记一个新连接，它的读写goroutine和握手计时器计入n.wg，节点停止时等它们结束
+// 调用时要持有peersLock，节点正在停止时返回false
+func (n *Node) trackPeerLocked(p *Peer) bool {
+	if n.peersClosed {
+		return false
+	}
+	n.livePeers[p] = true
+	n.wg.Add(4)
+	return true
+}
+
+// 启动读写goroutine，主动连出去的一方先发送version消息
+// 调用前要用trackPeerLocked登记
+func (p *Peer) start() {
+	p.mu.Lock()
+	p.handshakeTimer = time.AfterFunc(conf.HandshakeTimeout, p.handshakeTimeout)
+	p.mu.Unlock()
+	// 启动之前节点停止了，连接已经断开，不用再等计时器
+	if p.isClosed() {
+		p.stopHandshakeTimer()
+	}
+	go func() {
+		defer p.node.wg.Done()
+		p.writeLoop()
+	}()
+	go func() {
+		defer p.node.wg.Done()
+		p.readLoop()
+	}()
+	go func() {
+		defer p.node.wg.Done()
+		p.trickleLoop()
+	}()
+	if !p.inbound {
+		p.pushVersion()
+	}
+}
+
+// 握手计时器到期，还没有完成握手就断开连接
+func (p *Peer) handshakeTimeout() {
+	defer p.node.wg.Done()
+	if !p.isHandshakeDone() {
+		fmt.Printf("节点%s没有在规定时间内完成握手\n", p)
+		p.disconnect()
+	}
+}
+
+// 停止握手计时器，计时器还没有到期时由这里代替它结束n.wg里的计数
+func (p *Peer) stopHandshakeTimer() {
+	p.mu.Lock()
+	timer := p.handshakeTimer
+	p.handshakeTimer = nil
+	p.mu.Unlock()
+	if timer != nil && timer.Stop() {
+		p.node.wg.Done()
+	}
+}
+
+// 发送自己的version消息，每个连接只发送一次
+func (p *Peer) pushVersion() {
+	p.mu.Lock()
+	if p.versionSent {
+		p.mu.Unlock()
+		return
+	}
+	p.versionSent = true
+	p.mu.Unlock()
+	n := p.node
+	version := newVersion(n.chain.GetBestHeight(), n.localServices(), n.address, n.nonce)
+	p.send(conf.COMMAND_VERSION, encodePayload(&version))
+}
+
+func (p *Peer) isHandshakeDone() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.handshakeDone
+}
+
+// 对方发来的version消息，握手完成后才有
+func (p *Peer) remoteVersion() *Version {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.version
+}
+
+// 收到了version或者verack，两个都收到就完成握手，把握手期间积攒的消息发出去
+// 刚完成握手时返回true
+func (p *Peer) checkHandshake() bool {
+	p.mu.Lock()
+	if p.handshakeDone || p.version == nil || !p.verackReceived {
+		p.mu.Unlock()
+		return false
+	}
+	p.handshakeDone = true
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+	p.stopHandshakeTimer()
+	for _, msg := range pending {
+		p.enqueue(msg)
+	}
+	return true
+}
+
+// 发送消息，握手完成前只能发送握手消息，其他消息先存起来
+func (p *Peer) send(command string, payload []byte) {
+	p.mu.Lock()
+	if !p.handshakeDone && command != conf.COMMAND_VERSION && command != conf.COMMAND_VERACK {
+		if len(p.pending) >= conf.MaxSendQueue {
+			p.mu.Unlock()
+			fmt.Printf("节点%s的发送队列已满，断开连接\n", p)
+			p.disconnect()
+			return
+		}
+		p.pending = append(p.pending, outMessage{command, payload})
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	p.enqueue(outMessage{command, payload})
+}
+
+// 把消息放进发送队列，队列满了说明对方处理不过来，直接断开
+func (p *Peer) enqueue(msg outMessage) {
+	select {
+	case p.sendQueue <- msg:
+	case <-p.quit:
+	default:
+		fmt.Printf("节点%s的发送队列已满，断开连接\n", p)
+		p.disconnect()
+	}
+}
+
+// 断开连接，可以重复调用
+func (p *Peer) disconnect() {
+	p.closeOnce.Do(func() {
+		// 主动连接的节点没有完成握手，记一次连接失败
+		n := p.node
+		if !p.inbound && !p.isHandshakeDone() {
+			n.addrBook.Failed(p.addr)
+		}
+		close(p.quit)
+		p.conn.Close()
+		p.stopHandshakeTimer()
+		n.peersLock.Lock()
+		if n.peers[p.addr] == p {
+			delete(n.peers, p.addr)
+		}
+		delete(n.livePeers, p)
+		n.peersLock.Unlock()
+		// 同步和交易下载里正在向它请求的数据改为向其他节点请求
+		n.blockSync.removePeer(p)
+		n.txFetch.removePeer(p)
+		fmt.Printf("和节点%s断开了连接\n", p)
+	})
+}
+
+// 连接是否已经断开，断开以后同步和交易下载不再记录这个节点
+func (p *Peer) isClosed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Peer) readLoop() {
+	defer p.disconnect()
+	reader := bufio.NewReader(p.conn)
+	for {
+		command, payload, err := readMessage(reader)
+		if err != nil {
+			fmt.Printf("读取节点%s的消息失败: %v\n", p, err)
+			// 消息的格式不对，说明对方不遵守协议，而不是网络断开
+			if errors.Is(err, ErrBadMagic) || errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrBadChecksum) {
+				p.misbehaving(conf.ScoreMalformedMessage, err.Error())
+			}
+			return
+		}
+		p.node.handleMessage(p, command, payload)
+	}
+}
+
+func (p *Peer) writeLoop() {
+	defer p.disconnect()
+	for {
+		select {
+		case msg := <-p.sendQueue:
+			p.conn.SetWriteDeadline(time.Now().Add(conf.WriteTimeout))
+			if err := writeMessage(p.conn, msg.command, msg.payload); err != nil {
+				fmt.Printf("向节点%s发送消息失败: %v\n", p, err)
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// 生成version消息
+func newVersion(bestHeight int64, services uint64, addrFrom string, nonce uint64) Version {
+	return Version{conf.NODE_VERSION, services, time.Now().Unix(), nonce, conf.USER_AGENT, bestHeight, addrFrom}
+}
+
+// 本节点提供的服务，旧格式数据库升级上来的节点不提供区块，不算全节点
+func (n *Node) localServices() uint64 {
+	var services uint64
+	if !n.legacyChain {
+		services |= conf.SERVICE_FULL_NODE
+	}
+	if len(n.minerAddress) > 0 {
+		services |= conf.SERVICE_MINER
+	}
+	return services
+}
+
+// 生成一个随机数
+func randomNonce() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Panic(err)
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// 记下对方连进来的连接对应的节点地址，之后发给这个地址的消息都走这个连接
+func (n *Node) registerPeer(p *Peer, addr string) {
+	n.peersLock.Lock()
+	defer n.peersLock.Unlock()
+	if p.addr != "" {
+		return
+	}
+	p.addr = addr
+	if _, ok := n.peers[addr]; !ok {
+		n.peers[addr] = p
+	}
+}
+
+// 已经连接的节点地址，和主动连接的节点数量
+func (n *Node) connectedPeers() (map[string]bool, int) {
+	n.peersLock.Lock()
+	defer n.peersLock.Unlock()
+	addrs := make(map[string]bool)
+	outbound := 0
+	for addr, p := range n.peers {
+		addrs[addr] = true
+		if !p.inbound {
+			outbound++
+		}
+	}
+	return addrs, outbound
+}
+
+// 所有已经连接的节点
+func (n *Node) connectedPeerList() []*Peer {
+	n.peersLock.Lock()
+	defer n.peersLock.Unlock()
+	var list []*Peer
+	for _, p := range n.peers {
+		list = append(list, p)
+	}
+	return list
+}
+
+// 主动连接的节点数量，调用时要持有peersLock
+func (n *Node) outboundCountLocked() int {
+	count := 0
+	for _, p := range n.peers {
+		if !p.inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// 获取到节点的连接，还没有连接就建立一个
+// 被封禁的节点不连接，主动连接的节点数量达到上限或者节点正在停止时不建立新连接
+func (n *Node) connectPeer(addr string) (*Peer, error) {
+	if n.banList.IsBanned(addr) {
+		return nil, ErrPeerBanned
+	}
+	n.peersLock.Lock()
+	if p, ok := n.peers[addr]; ok {
+		n.peersLock.Unlock()
+		return p, nil
+	}
+	if n.peersClosed {
+		n.peersLock.Unlock()
+		return nil, ErrNodeStopped
+	}
+	if n.outboundCountLocked() >= conf.MaxOutboundPeers {
+		n.peersLock.Unlock()
+		return nil, ErrTooManyPeers
+	}
+	n.peersLock.Unlock()
+	conn, err := n.transport.Dial(addr, conf.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// 主动连接的一方总是使用加密连接
+	secureConn, err := secureOutbound(conn, n.nodeKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p := newPeer(n, secureConn, addr, false, secureConn.RemoteID())
+	n.peersLock.Lock()
+	if existing, ok := n.peers[addr]; ok {
+		//拨号的时候对方已经连进来了
+		n.peersLock.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	if !n.trackPeerLocked(p) {
+		n.peersLock.Unlock()
+		conn.Close()
+		return nil, ErrNodeStopped
+	}
+	n.peers[addr] = p
+	n.peersLock.Unlock()
+	p.start()
+	return p, nil
+}
+
+// 对方连进来：先完成加密握手，再开始收发消息，连接断开后才返回
+func (n *Node) acceptPeer(conn net.Conn) {
+	peerConn, nodeID, err := n.secureInbound(conn)
+	if err != nil {
+		fmt.Printf("和%s的加密握手失败: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	p := newPeer(n, peerConn, "", true, nodeID)
+	n.peersLock.Lock()
+	if !n.trackPeerLocked(p) {
+		n.peersLock.Unlock()
+		conn.Close()
+		return
+	}
+	n.peersLock.Unlock()
+	p.start()
+	<-p.quit
+}
+
+// 节点停止时断开所有连接，之后不再建立新的连接
+func (n *Node) closePeers() {
+	n.peersLock.Lock()
+	n.peersClosed = true
+	var list []*Peer
+	for p := range n.livePeers {
+		list = append(list, p)
+	}
+	n.peersLock.Unlock()
+	for _, p := range list {
+		p.disconnect()
+	}
+}
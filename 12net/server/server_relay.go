@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"publicchain/conf"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 一笔需要下载的交易
+type txRequest struct {
+	hash       []byte
+	seq        uint64    // 收到通知的顺序，按这个顺序请求，父交易一般在子交易前面
+	peer       *Peer     // 正在向哪个节点请求，为nil表示还没有请求
+	time       time.Time // 发出请求的时间
+	announcers []*Peer   // 其他通知过这笔交易的节点，请求失败时依次向它们请求
+}
+
+// 交易下载：收到inv里不认识的交易时向通知的节点请求，同一笔交易同时只向一个节点请求
+// 对方回复notfound或者请求超时，就换一个通知过这笔交易的节点
+// 向一个节点请求的交易太多时先排队，有请求结束了再发出去
+type txFetcher struct {
+	node     *Node
+	lock     sync.Mutex
+	requests map[string]*txRequest
+	inFlight map[*Peer]int // 每个节点正在请求的交易数量
+	nextSeq  uint64
+}
+
+func newTxFetcher(node *Node) *txFetcher {
+	return &txFetcher{
+		node:     node,
+		requests: make(map[string]*txRequest),
+		inFlight: make(map[*Peer]int),
+	}
+}
+
+// 定时检查超时的请求
+func (f *txFetcher) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.checkTimeouts()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 对方通知了一批交易，交易池里没有并且还没有请求的交易向它请求
+func (f *txFetcher) onInv(p *Peer, hashes [][]byte) {
+	f.lock.Lock()
+	if p.isClosed() {
+		f.lock.Unlock()
+		return
+	}
+	for _, hash := range hashes {
+		if f.node.txPool.Has(hash) {
+			continue
+		}
+		if req, ok := f.requests[string(hash)]; ok {
+			if req.peer != p && !containsPeer(req.announcers, p) {
+				req.announcers = append(req.announcers, p)
+			}
+			continue
+		}
+		if len(f.requests) >= conf.MaxTxRequests {
+			continue
+		}
+		f.nextSeq++
+		f.requests[string(hash)] = &txRequest{hash: hash, seq: f.nextSeq, announcers: []*Peer{p}}
+	}
+	sends := f.schedule()
+	f.lock.Unlock()
+	f.sendTxRequests(sends)
+}
+
+// 收到了交易，不管交易是否合法都不用再请求了
+func (f *txFetcher) onTx(hash []byte) {
+	f.lock.Lock()
+	req, ok := f.requests[string(hash)]
+	if !ok {
+		f.lock.Unlock()
+		return
+	}
+	if req.peer != nil {
+		f.release(req.peer)
+	}
+	delete(f.requests, string(hash))
+	sends := f.schedule()
+	f.lock.Unlock()
+	f.sendTxRequests(sends)
+}
+
+// 对方没有请求的交易，换一个节点请求
+func (f *txFetcher) onNotFound(p *Peer, hashes [][]byte) {
+	f.lock.Lock()
+	for _, hash := range hashes {
+		if req, ok := f.requests[string(hash)]; ok && req.peer == p {
+			f.retry(req)
+		}
+	}
+	sends := f.schedule()
+	f.lock.Unlock()
+	f.sendTxRequests(sends)
+}
+
+// 请求超时的交易换一个节点请求
+func (f *txFetcher) checkTimeouts() {
+	f.lock.Lock()
+	now := time.Now()
+	for _, req := range f.requests {
+		if req.peer == nil || now.Sub(req.time) < conf.TxRequestTimeout {
+			continue
+		}
+		fmt.Printf("向节点%s请求交易%x超时\n", req.peer, req.hash)
+		f.retry(req)
+	}
+	sends := f.schedule()
+	f.lock.Unlock()
+	f.sendTxRequests(sends)
+}
+
+// 节点断开了：不再向它请求，正在向它请求的交易换一个通知过的节点
+func (f *txFetcher) removePeer(p *Peer) {
+	f.lock.Lock()
+	for _, req := range f.requests {
+		for i, announcer := range req.announcers {
+			if announcer == p {
+				req.announcers = append(req.announcers[:i], req.announcers[i+1:]...)
+				break
+			}
+		}
+		if req.peer == p {
+			f.retry(req)
+		} else if req.peer == nil && len(req.announcers) == 0 {
+			delete(f.requests, string(req.hash))
+		}
+	}
+	delete(f.inFlight, p)
+	sends := f.schedule()
+	f.lock.Unlock()
+	f.sendTxRequests(sends)
+}
+
+// 请求失败，等待向下一个通知过这笔交易的节点请求，没有节点可以请求了就删掉
+func (f *txFetcher) retry(req *txRequest) {
+	f.release(req.peer)
+	req.peer = nil
+	if len(req.announcers) == 0 {
+		delete(f.requests, string(req.hash))
+	}
+}
+
+// 按收到通知的顺序给还没有请求的交易分配节点，返回要发出的请求
+// 请求在锁外面发送，这里返回的是复制出来的请求
+func (f *txFetcher) schedule() []txRequest {
+	var waiting []*txRequest
+	for _, req := range f.requests {
+		if req.peer == nil {
+			waiting = append(waiting, req)
+		}
+	}
+	sort.Slice(waiting, func(i, j int) bool {
+		return waiting[i].seq < waiting[j].seq
+	})
+	var sends []txRequest
+	for _, req := range waiting {
+		for i, p := range req.announcers {
+			if f.inFlight[p] >= conf.MaxTxInFlightPerPeer {
+				continue
+			}
+			req.peer = p
+			req.time = time.Now()
+			req.announcers = append(req.announcers[:i], req.announcers[i+1:]...)
+			f.inFlight[p]++
+			sends = append(sends, *req)
+			break
+		}
+	}
+	return sends
+}
+
+// 节点的一个请求结束了
+func (f *txFetcher) release(p *Peer) {
+	f.inFlight[p]--
+	if f.inFlight[p] <= 0 {
+		delete(f.inFlight, p)
+	}
+}
+
+func (f *txFetcher) sendTxRequests(requests []txRequest) {
+	for _, req := range requests {
+		f.node.SendGetData(req.peer, conf.TX_TYPE, req.hash)
+	}
+}
+
+func containsPeer(peers []*Peer, p *Peer) bool {
+	for _, peer := range peers {
+		if peer == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,631 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"publicchain/conf"
+	"publicchain/mempool"
+	"publicchain/pbcc"
+	"publicchain/wallet"
+	"sort"
+)
+
+// JSON-RPC 2.0服务：运行中的节点通过HTTP POST提供查询和提交交易的接口
+// 命令行直接打开数据库，节点运行时数据库被锁住，这时只能通过RPC访问节点
+// 请求用HTTP基本认证，用户名是conf.RPCCookieUser，密码是节点启动时随机生成并写进cookie文件的，
+// 只有能读cookie文件的本机用户才能访问。参数只支持按位置传递的数组，支持批量请求
+
+// JSON-RPC 2.0规定的错误码
+const (
+	rpcParseError     = -32700 // 请求不是合法的JSON
+	rpcInvalidRequest = -32600 // 请求的格式不对
+	rpcMethodNotFound = -32601 // 方法不存在
+	rpcInvalidParams  = -32602 // 参数不对
+	rpcInternalError  = -32603 // 节点内部错误
+)
+
+// 各个方法使用的错误码，和比特币节点的一样
+const (
+	rpcNotFound       = -5  // 区块或交易不存在
+	rpcInvalidAddress = -8  // 参数的值不对，比如地址无效、高度超出范围
+	rpcTxRejected     = -26 // 交易没有通过校验
+	rpcTxInPool       = -27 // 交易已经在交易池里
+)
+
+// 一个RPC请求，ID为空说明是通知，不需要回复
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// 一个RPC回复，Result和Error只有一个
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// RPC方法返回的错误，其他的错误都当作rpcInternalError
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func newRPCError(code int, format string, args ...interface{}) *rpcError {
+	return &rpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// 一个RPC方法，params是按位置传递的参数
+type rpcHandler func(n *Node, params []json.RawMessage) (interface{}, error)
+
+var rpcHandlers = map[string]rpcHandler{
+	"getblockcount":      (*Node).rpcGetBlockCount,
+	"getblockhash":       (*Node).rpcGetBlockHash,
+	"getblock":           (*Node).rpcGetBlock,
+	"getrawtransaction":  (*Node).rpcGetRawTransaction,
+	"sendrawtransaction": (*Node).rpcSendRawTransaction,
+	"getbalance":         (*Node).rpcGetBalance,
+	"listunspent":        (*Node).rpcListUnspent,
+	"getmempoolinfo":     (*Node).rpcGetMempoolInfo,
+	"getpeerinfo":        (*Node).rpcGetPeerInfo,
+	"listbanned":         (*Node).rpcListBanned,
+	"clearbanned":        (*Node).rpcClearBanned,
+	"stop":               (*Node).rpcStop,
+}
+
+// 启动RPC服务：生成cookie文件，然后在后台处理请求
+func (n *Node) startRPC(addr string) error {
+	cookie, err := writeRPCCookie(n.rpcCookieFile())
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen(conf.PROTOCOL, addr)
+	if err != nil {
+		os.Remove(n.rpcCookieFile())
+		return err
+	}
+	n.rpcCookie = cookie
+	n.rpcServer = &http.Server{
+		Handler:      n,
+		ReadTimeout:  conf.RPCTimeout,
+		WriteTimeout: conf.RPCTimeout,
+	}
+	fmt.Printf("RPC服务地址:%s，密码在%s\n", ln.Addr(), n.rpcCookieFile())
+	n.goTracked(func() {
+		if err := n.rpcServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("RPC服务出错:", err)
+		}
+	})
+	return nil
+}
+
+// 停止RPC服务，等正在处理的请求处理完，然后删除cookie文件
+func (n *Node) stopRPC() {
+	if n.rpcServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), conf.RPCShutdownTimeout)
+	defer cancel()
+	if err := n.rpcServer.Shutdown(ctx); err != nil {
+		n.rpcServer.Close()
+	}
+	os.Remove(n.rpcCookieFile())
+}
+
+func (n *Node) rpcCookieFile() string {
+	return fmt.Sprintf(conf.RPCCookieFile, n.config.NodeID)
+}
+
+// 生成随机密码，写进只有自己能读的cookie文件，格式是"用户名:密码"
+func writeRPCCookie(path string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	cookie := hex.EncodeToString(secret)
+	if err := ioutil.WriteFile(path, []byte(conf.RPCCookieUser+":"+cookie), 0600); err != nil {
+		return "", err
+	}
+	return cookie, nil
+}
+
+// 处理HTTP请求：检查认证，然后解析单个或批量的RPC请求
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user != conf.RPCCookieUser || subtle.ConstantTimeCompare([]byte(password), []byte(n.rpcCookie)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "认证失败", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, conf.MaxRPCRequestSize+1))
+	if err != nil {
+		return
+	}
+	if len(body) > conf.MaxRPCRequestSize {
+		http.Error(w, "请求太大", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var result interface{}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		result = n.handleRPCBatch(trimmed)
+	} else if response := n.handleRPCRequest(trimmed); response != nil {
+		result = response
+	}
+	// 全部是通知时不回复任何内容
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// 处理批量请求，返回回复的数组，全部是通知时返回nil
+func (n *Node) handleRPCBatch(body []byte) interface{} {
+	var requests []json.RawMessage
+	if err := json.Unmarshal(body, &requests); err != nil {
+		return errorResponse(nil, newRPCError(rpcParseError, "请求解析失败: %v", err))
+	}
+	if len(requests) == 0 {
+		return errorResponse(nil, newRPCError(rpcInvalidRequest, "批量请求是空的"))
+	}
+	var responses []*rpcResponse
+	for _, request := range requests {
+		if response := n.handleRPCRequest(request); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// 处理一个请求，通知返回nil
+func (n *Node) handleRPCRequest(body []byte) *rpcResponse {
+	var request rpcRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return errorResponse(nil, newRPCError(rpcParseError, "请求解析失败: %v", err))
+		}
+		return errorResponse(nil, newRPCError(rpcInvalidRequest, "请求的格式不对: %v", err))
+	}
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return errorResponse(request.ID, newRPCError(rpcInvalidRequest, "请求的格式不对"))
+	}
+	result, err := n.callRPC(request.Method, request.Params)
+	if request.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = newRPCError(rpcInternalError, "%v", err)
+		}
+		return errorResponse(request.ID, rpcErr)
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(request.ID, newRPCError(rpcInternalError, "%v", err))
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: resultBytes, ID: request.ID}
+}
+
+func errorResponse(id json.RawMessage, err *rpcError) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", Error: err, ID: id}
+}
+
+// 调用方法，参数必须是数组或者省略
+func (n *Node) callRPC(method string, rawParams json.RawMessage) (interface{}, error) {
+	handler, ok := rpcHandlers[method]
+	if !ok {
+		return nil, newRPCError(rpcMethodNotFound, "方法%s不存在", method)
+	}
+	var params []json.RawMessage
+	if len(rawParams) > 0 && !bytes.Equal(rawParams, []byte("null")) {
+		if err := json.Unmarshal(rawParams, &params); err != nil {
+			return nil, newRPCError(rpcInvalidParams, "参数必须是数组")
+		}
+	}
+	return handler(n, params)
+}
+
+// 把参数依次解析到args里，required个以后的参数可以省略
+func parseParams(params []json.RawMessage, required int, args ...interface{}) error {
+	if len(params) < required || len(params) > len(args) {
+		return newRPCError(rpcInvalidParams, "参数数量不对，需要%d到%d个", required, len(args))
+	}
+	for i, param := range params {
+		if err := json.Unmarshal(param, args[i]); err != nil {
+			return newRPCError(rpcInvalidParams, "第%d个参数不对: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// 解析十六进制的hash参数
+func parseHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) == 0 {
+		return nil, newRPCError(rpcInvalidAddress, "hash %q不对", s)
+	}
+	return hash, nil
+}
+
+// 检查地址参数
+func checkAddress(address string) error {
+	if !wallet.IsValidForAddress([]byte(address)) {
+		return newRPCError(rpcInvalidAddress, "地址%s无效", address)
+	}
+	return nil
+}
+
+// 区块在主链上的确认数，不在主链上时为-1
+func (n *Node) confirmations(blockHash []byte, height int64) int64 {
+	mainHash, err := n.chain.GetBlockHashByHeight(height)
+	if err != nil || !bytes.Equal(mainHash, blockHash) {
+		return -1
+	}
+	return n.chain.GetBestHeight() - height + 1
+}
+
+// getblockcount 返回主链最新区块的高度
+func (n *Node) rpcGetBlockCount(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return n.chain.GetBestHeight(), nil
+}
+
+// getblockhash height 返回主链上这个高度的区块hash
+func (n *Node) rpcGetBlockHash(params []json.RawMessage) (interface{}, error) {
+	var height int64
+	if err := parseParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+	hash, err := n.chain.GetBlockHashByHeight(height)
+	if err != nil {
+		return nil, newRPCError(rpcInvalidAddress, "%v", err)
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+// getblock返回的区块
+type rpcBlock struct {
+	Hash              string   `json:"hash"`
+	Confirmations     int64    `json:"confirmations"`
+	Size              int      `json:"size"`
+	Height            int64    `json:"height"`
+	Version           uint32   `json:"version"`
+	MerkleRoot        string   `json:"merkleroot"`
+	Time              int64    `json:"time"`
+	Bits              string   `json:"bits"`
+	Nonce             int64    `json:"nonce"`
+	PreviousBlockHash string   `json:"previousblockhash"`
+	Tx                []string `json:"tx"`
+}
+
+// getblock hash [verbose=true] 返回区块，verbose为false时返回序列化后的十六进制
+func (n *Node) rpcGetBlock(params []json.RawMessage) (interface{}, error) {
+	var hashString string
+	verbose := true
+	if err := parseParams(params, 1, &hashString, &verbose); err != nil {
+		return nil, err
+	}
+	hash, err := parseHash(hashString)
+	if err != nil {
+		return nil, err
+	}
+	blockBytes, err := n.chain.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+	if blockBytes == nil {
+		return nil, newRPCError(rpcNotFound, "区块%s不存在", hashString)
+	}
+	if !verbose {
+		return hex.EncodeToString(blockBytes), nil
+	}
+	block, err := pbcc.DecodeBlock(blockBytes)
+	if err != nil {
+		return nil, err
+	}
+	result := &rpcBlock{
+		Hash:              hex.EncodeToString(block.Hash),
+		Confirmations:     n.confirmations(block.Hash, block.Height),
+		Size:              len(blockBytes),
+		Height:            block.Height,
+		Version:           block.Version,
+		MerkleRoot:        hex.EncodeToString(block.MerkleRoot),
+		Time:              block.TimeStamp,
+		Bits:              fmt.Sprintf("%08x", block.Bits),
+		Nonce:             block.Nonce,
+		PreviousBlockHash: hex.EncodeToString(block.PrevBlockHash),
+		Tx:                []string{},
+	}
+	for _, tx := range block.Txs {
+		result.Tx = append(result.Tx, hex.EncodeToString(tx.TxID))
+	}
+	return result, nil
+}
+
+// getrawtransaction返回的交易
+type rpcTransaction struct {
+	TxID          string     `json:"txid"`
+	Hex           string     `json:"hex"`
+	Vin           []rpcTxIn  `json:"vin"`
+	Vout          []rpcTxOut `json:"vout"`
+	BlockHash     string     `json:"blockhash,omitempty"`
+	Confirmations int64      `json:"confirmations"`
+}
+
+type rpcTxIn struct {
+	TxID string `json:"txid,omitempty"` // coinbase交易的输入没有txid
+	Vout int    `json:"vout"`
+}
+
+type rpcTxOut struct {
+	Value   int64  `json:"value"`
+	N       int    `json:"n"`
+	Address string `json:"address"`
+}
+
+// getrawtransaction txid [verbose=false] 在交易池和主链上查找交易，返回序列化后的十六进制
+// verbose为true时返回交易的详细内容，交易池里的交易确认数为0
+func (n *Node) rpcGetRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var txIDString string
+	verbose := false
+	if err := parseParams(params, 1, &txIDString, &verbose); err != nil {
+		return nil, err
+	}
+	txID, err := parseHash(txIDString)
+	if err != nil {
+		return nil, err
+	}
+	var blockHash []byte
+	tx := n.txPool.Get(txID)
+	if tx == nil {
+		tx, blockHash = n.chain.FindTransaction(txID)
+	}
+	if tx == nil {
+		return nil, newRPCError(rpcNotFound, "交易%s不存在", txIDString)
+	}
+	txHex := hex.EncodeToString(tx.Serialize())
+	if !verbose {
+		return txHex, nil
+	}
+	result := &rpcTransaction{
+		TxID: hex.EncodeToString(tx.TxID),
+		Hex:  txHex,
+		Vin:  []rpcTxIn{},
+		Vout: []rpcTxOut{},
+	}
+	for _, in := range tx.Vins {
+		result.Vin = append(result.Vin, rpcTxIn{hex.EncodeToString(in.TxID), in.Vout})
+	}
+	for i, out := range tx.Vouts {
+		result.Vout = append(result.Vout, rpcTxOut{out.Value, i, string(wallet.PubKeyHashToAddress(out.PubKeyHash))})
+	}
+	if blockHash != nil {
+		header, err := n.chain.GetHeader(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		result.BlockHash = hex.EncodeToString(blockHash)
+		result.Confirmations = n.confirmations(blockHash, header.Height)
+	}
+	return result, nil
+}
+
+// sendrawtransaction hex 提交序列化后的交易，校验通过后放进交易池并转发给其他节点，返回交易ID
+func (n *Node) rpcSendRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var txHex string
+	if err := parseParams(params, 1, &txHex); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, newRPCError(rpcInvalidParams, "交易不是十六进制: %v", err)
+	}
+	tx, err := pbcc.DecodeTransaction(data)
+	if err != nil {
+		return nil, newRPCError(rpcInvalidParams, "交易数据解析失败: %v", err)
+	}
+	if err := n.SubmitTransaction(tx); err != nil {
+		if errors.Is(err, mempool.ErrTxExists) {
+			return nil, newRPCError(rpcTxInPool, "%v", err)
+		}
+		return nil, newRPCError(rpcTxRejected, "%v", err)
+	}
+	return hex.EncodeToString(tx.TxID), nil
+}
+
+// getbalance address 返回地址在主链上的余额，不包括交易池里的交易
+func (n *Node) rpcGetBalance(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if err := checkAddress(address); err != nil {
+		return nil, err
+	}
+	var balance int64
+	for _, utxo := range n.chain.FindUnspentOutputs(address) {
+		balance += utxo.Output.Value
+	}
+	return balance, nil
+}
+
+// listunspent返回的未花费输出
+type rpcUnspent struct {
+	TxID          string `json:"txid"`
+	Vout          int    `json:"vout"`
+	Address       string `json:"address"`
+	Amount        int64  `json:"amount"`
+	Height        int64  `json:"height"`
+	Confirmations int64  `json:"confirmations"`
+	Coinbase      bool   `json:"coinbase"`
+	Spendable     bool   `json:"spendable"` // coinbase交易的输出要成熟以后才能花
+}
+
+// listunspent address 返回地址在主链上的所有未花费输出
+func (n *Node) rpcListUnspent(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, 1, &address); err != nil {
+		return nil, err
+	}
+	if err := checkAddress(address); err != nil {
+		return nil, err
+	}
+	bestHeight := n.chain.GetBestHeight()
+	result := []*rpcUnspent{}
+	for _, utxo := range n.chain.FindUnspentOutputs(address) {
+		result = append(result, &rpcUnspent{
+			TxID:          hex.EncodeToString(utxo.TxID),
+			Vout:          utxo.Index,
+			Address:       address,
+			Amount:        utxo.Output.Value,
+			Height:        utxo.Height,
+			Confirmations: bestHeight - utxo.Height + 1,
+			Coinbase:      utxo.Coinbase,
+			Spendable:     utxo.IsMature(bestHeight + 1),
+		})
+	}
+	return result, nil
+}
+
+// getmempoolinfo返回的交易池信息
+type rpcMempoolInfo struct {
+	Size  int   `json:"size"`  // 交易数量
+	Bytes int   `json:"bytes"` // 交易序列化后的总字节数
+	Fees  int64 `json:"fees"`  // 手续费总额
+}
+
+// getmempoolinfo 返回交易池的交易数量、大小和手续费
+func (n *Node) rpcGetMempoolInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	result := &rpcMempoolInfo{}
+	for _, desc := range n.txPool.TxDescs() {
+		result.Size++
+		result.Bytes += desc.Size
+		result.Fees += desc.Fee
+	}
+	return result, nil
+}
+
+// getpeerinfo返回的连接信息
+type rpcPeerInfo struct {
+	Addr          string `json:"addr"`
+	NodeID        string `json:"nodeid,omitempty"` // 明文连接没有节点ID
+	Inbound       bool   `json:"inbound"`
+	Encrypted     bool   `json:"encrypted"`
+	HandshakeDone bool   `json:"handshakedone"`
+	Version       int64  `json:"version,omitempty"`
+	Services      uint64 `json:"services,omitempty"`
+	UserAgent     string `json:"useragent,omitempty"`
+	StartHeight   int64  `json:"startheight"` // 握手时对方的高度
+	BanScore      int    `json:"banscore"`
+}
+
+// getpeerinfo 返回所有连接，包括还没有完成握手的
+func (n *Node) rpcGetPeerInfo(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	n.peersLock.Lock()
+	var peers []*Peer
+	for p := range n.livePeers {
+		peers = append(peers, p)
+	}
+	n.peersLock.Unlock()
+	result := []*rpcPeerInfo{}
+	for _, p := range peers {
+		info := &rpcPeerInfo{
+			Addr:      p.String(),
+			NodeID:    p.nodeID,
+			Inbound:   p.inbound,
+			Encrypted: p.nodeID != "",
+		}
+		p.mu.Lock()
+		info.HandshakeDone = p.handshakeDone
+		info.BanScore = p.score
+		if p.version != nil {
+			info.Version = p.version.Version
+			info.Services = p.version.Services
+			info.UserAgent = p.version.UserAgent
+			info.StartHeight = p.version.BestHeight
+		}
+		p.mu.Unlock()
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Addr < result[j].Addr })
+	return result, nil
+}
+
+// listbanned返回的封禁
+type rpcBanned struct {
+	Address     string `json:"address"`
+	BannedUntil int64  `json:"banned_until"`
+	Reason      string `json:"reason"`
+}
+
+// listbanned 返回还在封禁期间的节点地址
+func (n *Node) rpcListBanned(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	result := []*rpcBanned{}
+	for _, ban := range n.banList.List() {
+		result = append(result, &rpcBanned{ban.Addr, ban.Until, ban.Reason})
+	}
+	return result, nil
+}
+
+// clearbanned 解除所有封禁并保存，节点停止时保存的封禁列表里也就没有了
+func (n *Node) rpcClearBanned(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	count := len(n.banList.List())
+	n.banList.Clear()
+	if err := n.banList.Save(); err != nil {
+		return nil, err
+	}
+	return fmt.Sprintf("解除了%d个节点的封禁", count), nil
+}
+
+// stop 停止节点，回复发出去以后节点才开始停止
+func (n *Node) rpcStop(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	go n.Stop()
+	return "节点正在停止", nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"publicchain/conf"
+	"publicchain/crypto"
+	"time"
+)
+
+// 要求加密时对方用明文连进来
+var ErrEncryptionRequired = errors.New("本节点要求加密连接")
+
+// 加密握手的prologue，不同网络的节点握手会失败
+func securePrologue() []byte {
+	prologue := make([]byte, 4)
+	binary.BigEndian.PutUint32(prologue, conf.NetworkMagic)
+	return prologue
+}
+
+// 主动连接的一方：先发送conf.SecureMagic表示要加密，然后用key进行加密握手
+func secureOutbound(conn net.Conn, key *crypto.NodeKey) (*crypto.SecureConn, error) {
+	conn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	var magic [4]byte
+	binary.BigEndian.PutUint32(magic[:], conf.SecureMagic)
+	if _, err := conn.Write(magic[:]); err != nil {
+		return nil, err
+	}
+	return crypto.SecureClient(conn, key, securePrologue())
+}
+
+// 被连接的一方：开头是conf.SecureMagic的连接进行加密握手，其他的是明文连接
+// 返回之后用来收发消息的连接和对方的节点ID，明文连接没有节点ID，要求加密时拒绝明文连接
+func (n *Node) secureInbound(conn net.Conn) (net.Conn, string, error) {
+	conn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	magic, err := reader.Peek(4)
+	if err != nil {
+		return nil, "", err
+	}
+	buffered := &bufferedConn{conn, reader}
+	if binary.BigEndian.Uint32(magic) != conf.SecureMagic {
+		if n.config.RequireEncryption {
+			return nil, "", ErrEncryptionRequired
+		}
+		return buffered, "", nil
+	}
+	reader.Discard(4)
+	secureConn, err := crypto.SecureServer(buffered, n.nodeKey, securePrologue())
+	if err != nil {
+		return nil, "", err
+	}
+	return secureConn, secureConn.RemoteID(), nil
+}
+
+// 判断连接类型时已经读出来的数据留在缓冲里，之后的读取先读缓冲
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
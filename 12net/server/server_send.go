@@ -1,85 +1,103 @@
 package server
 
 import (
-	"bytes"
 	"fmt"
-	"io"
-	"log"
-	"net"
 	"publicchain/conf"
 	"publicchain/pbcc"
-	"publicchain/utils"
 )
 
-// 像其他节点发送数据
-func SendData(to string, data []byte) {
-	// 获取链接对象
-	conn, err := net.Dial(conf.PROTOCOL, to)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-	// 附带要发送的数据
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+//组装获取区块头消息并发送
+func (n *Node) SendGetHeaders(peer *Peer, locator [][]byte) {
+	payload := encodePayload(&GetHeaders{locator, nil})
+	fmt.Printf("向节点%s发送了GetHeaders消息\n", peer)
+	peer.send(conf.COMMAND_GETHEADERS, payload)
+}
+
+//组装区块头消息并发送
+func (n *Node) SendHeaders(peer *Peer, headers []*pbcc.BlockHeader) {
+	var items [][]byte
+	for _, header := range headers {
+		items = append(items, header.Serialize())
 	}
+	payload := encodePayload(&Headers{items})
+	fmt.Printf("节点%s向节点%s发送了%d个区块头\n", n.address, peer, len(headers))
+	peer.send(conf.COMMAND_HEADERS, payload)
 }
 
-//组装版本消息数据并发送
-func SendVersion(toAddress string, blc *pbcc.BlockChain) {
-	// 获取获取区块高度
-	bestHeight := blc.GetBestHeight()
-	// 组装版本数据
-	payload := utils.GobEncode(Version{conf.NODE_VERSION, bestHeight, NodeAddress})
-	// 把命令和数据组成请求
-	request := append(utils.CommandToBytes(conf.COMMAND_VERSION), payload...)
-	fmt.Printf("节点%s向节点%s发送了version消息\n", NodeAddress, toAddress)
-	// 数据发送
-	SendData(toAddress, request)
+// 发送GetAddr消息，没有内容
+func (n *Node) SendGetAddr(peer *Peer) {
+	peer.send(conf.COMMAND_GETADDR, nil)
 }
 
-//组装获取区块消息并发送
-func SendGetBlocks(toAddress string) {
-	// 指定从全节点获取
-	payload := utils.GobEncode(GetBlocks{NodeAddress})
-	// 拼接命令和数据
-	request := append(utils.CommandToBytes(conf.COMMAND_GETBLOCKS), payload...)
-	fmt.Printf("向节点地址为:%s的节点发送了GetBlock消息\n", toAddress)
-	SendData(toAddress, request)
+// 组装Addr消息并发送
+func (n *Node) SendAddr(peer *Peer, addrs []NetAddress) {
+	payload := encodePayload(&Addr{addrs})
+	fmt.Printf("节点%s向节点%s发送了%d个节点地址\n", n.address, peer, len(addrs))
+	peer.send(conf.COMMAND_ADDR, payload)
 }
 
-// 组装Inv消息并发送
-func SendInv(toAddress string, kind string, hashes [][]byte) {
-	// 从全节点获取
-	payload := utils.GobEncode(Inv{NodeAddress, kind, hashes})
-	// 拼接命令和数据
-	request := append(utils.CommandToBytes(conf.COMMAND_INV), payload...)
-	fmt.Printf("节点%s向节点%s发送了Inv消息\n", NodeAddress, toAddress)
-	SendData(toAddress, request)
+// 发送MemPool消息，没有内容
+func (n *Node) SendMempool(peer *Peer) {
+	fmt.Printf("节点%s向节点%s请求交易池中的交易\n", n.address, peer)
+	peer.send(conf.COMMAND_MEMPOOL, nil)
+}
+
+// 向所有握手完成的节点通知区块或交易，except是消息的来源，不再发回去
+// 区块马上通知，交易放进每个节点的队列，由trickleLoop定时合并发送，对方已经知道的不再通知
+// 旧格式数据库升级上来的节点不提供区块，也就不通知区块
+func (n *Node) broadcastInv(kind string, hashes [][]byte, except *Peer) {
+	if kind == conf.BLOCK_TYPE && n.legacyChain {
+		return
+	}
+	for _, peer := range n.connectedPeerList() {
+		if peer == except || !peer.isHandshakeDone() {
+			continue
+		}
+		if kind == conf.TX_TYPE {
+			for _, hash := range hashes {
+				peer.queueInv(hash)
+			}
+			continue
+		}
+		var unknown [][]byte
+		for _, hash := range hashes {
+			if !peer.knownInventory.Has(hash) {
+				peer.knownInventory.Add(hash)
+				unknown = append(unknown, hash)
+			}
+		}
+		if len(unknown) > 0 {
+			fmt.Printf("节点%s向节点%s发送了Inv消息\n", n.address, peer)
+			peer.pushInv(kind, unknown)
+		}
+	}
 }
 
 // 组装GetData消息并发送
-func SendGetData(toAddress string, kind string, blockHash []byte) {
+func (n *Node) SendGetData(peer *Peer, kind string, blockHash []byte) {
 	// 向全节点获取
-	payload := utils.GobEncode(GetData{NodeAddress, kind, blockHash})
-	request := append(utils.CommandToBytes(conf.COMMAND_GETDATA), payload...)
-	fmt.Printf("节点%s向节点%s发送了GetData消息\n", NodeAddress, toAddress)
-	SendData(toAddress, request)
+	payload := encodePayload(&GetData{kind, blockHash})
+	fmt.Printf("节点%s向节点%s发送了GetData消息\n", n.address, peer)
+	peer.send(conf.COMMAND_GETDATA, payload)
+}
+
+// 组装NotFound消息并发送
+func (n *Node) SendNotFound(peer *Peer, kind string, hashes [][]byte) {
+	payload := encodePayload(&NotFound{kind, hashes})
+	fmt.Printf("节点%s向节点%s发送了NotFound消息\n", n.address, peer)
+	peer.send(conf.COMMAND_NOTFOUND, payload)
 }
 
 // 组装BlockData消息并发送
-func SendBlock(toAddress string, block []byte) {
-	payload := utils.GobEncode(BlockData{NodeAddress, block})
-	request := append(utils.CommandToBytes(conf.COMMAND_BLOCK), payload...)
-	fmt.Printf("节点%s向节点%s发送了Block消息\n", NodeAddress, toAddress)
-	SendData(toAddress, request)
+func (n *Node) SendBlock(peer *Peer, block []byte) {
+	payload := encodePayload(&BlockData{block})
+	fmt.Printf("节点%s向节点%s发送了Block消息\n", n.address, peer)
+	peer.send(conf.COMMAND_BLOCK, payload)
 }
 
 // 组装TXData消息并发送
-func SendTx(toAddress string, tx *pbcc.Transaction) {
-	payload := utils.GobEncode(Tx{NodeAddress, tx})
-	request := append(utils.CommandToBytes(conf.COMMAND_TX), payload...)
-	fmt.Printf("节点%s向节点%s发送了Tx消息\n", NodeAddress, toAddress)
-	SendData(toAddress, request)
+func (n *Node) SendTx(peer *Peer, tx *pbcc.Transaction) {
+	payload := encodePayload(&Tx{tx.Serialize()})
+	fmt.Printf("节点%s向节点%s发送了Tx消息\n", n.address, peer)
+	peer.send(conf.COMMAND_TX, payload)
 }
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"publicchain/conf"
+	"publicchain/pbcc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 一个需要下载的区块，区块头已经校验并存储了
+type blockRequest struct {
+	hash    []byte
+	height  int64
+	work    *big.Int       // 从创世区块到这个区块累计的工作量
+	peer    *Peer          // 正在向哪个节点请求，为nil表示还没有请求
+	time    time.Time      // 发出请求的时间
+	stalled map[*Peer]bool // 请求超时过的节点，重新请求时先不选它们
+	block   *pbcc.Block    // 已经收到，等上一个区块接入以后再接入
+	from    *Peer          // 区块是哪个节点发来的
+}
+
+// 同步时记录的其他节点的状态
+type peerState struct {
+	height        int64 // 对方主链的高度
+	inFlight      int   // 正在向它请求的区块数量
+	stalls        int   // 连续超时的次数，发来不合法的数据时直接设为conf.MaxPeerStalls
+	headersSynced bool  // 对方的区块头已经同步完了，它通知新区块以前不用再向它请求
+}
+
+// 区块同步：先从一个节点按批同步区块头，区块头校验通过后再从多个节点并行下载区块
+// 区块按高度顺序请求，收到后等上一个区块接入了再接入，请求超时就换一个节点
+// 节点的状态按连接记录，请求和回复都走同一个连接
+type syncManager struct {
+	lock             sync.Mutex
+	node             *Node
+	bc               Chain
+	peers            map[*Peer]*peerState
+	headersPeer      *Peer     // 正在向哪个节点同步区块头
+	headersTime      time.Time // 发出区块头请求的时间
+	bestHeader       []byte    // 已经校验过的累计工作量最大的区块头
+	bestHeaderHeight int64
+	bestHeaderWork   *big.Int
+	requests         []*blockRequest // 按高度排序
+	mempoolPeers     []*Peer         // 同步完成后要请求交易池的节点
+}
+
+func newSyncManager(node *Node) *syncManager {
+	m := &syncManager{
+		node:  node,
+		bc:    node.chain,
+		peers: make(map[*Peer]*peerState),
+	}
+	m.resetBest()
+	return m
+}
+
+// 定时检查超时的请求
+func (m *syncManager) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.checkTimeouts()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// 节点断开了：删掉它的状态，正在向它请求的区块头和区块改为向其他节点请求
+func (m *syncManager) removePeer(p *Peer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.peers, p)
+	for _, req := range m.requests {
+		if req.peer == p {
+			req.peer = nil
+		}
+		delete(req.stalled, p)
+	}
+	for i, peer := range m.mempoolPeers {
+		if peer == p {
+			m.mempoolPeers = append(m.mempoolPeers[:i], m.mempoolPeers[i+1:]...)
+			break
+		}
+	}
+	if m.headersPeer == p {
+		m.headersPeer = nil
+		m.requestHeadersFromBestPeer()
+	}
+	m.scheduleDownloads()
+	m.checkSyncDone()
+}
+
+// 本地挖出区块或者收到广播的区块以后，主链的工作量可能比同步到的区块头还大
+func (m *syncManager) refreshBest() {
+	m.considerBest(m.bc.GetTipHash(), m.bc.GetBestHeight(), nil)
+}
+
+// 区块头的累计工作量比最好的区块头大时换成它，work为nil时从区块链查
+// 返回区块头的累计工作量，查不到时返回nil
+func (m *syncManager) considerBest(hash []byte, height int64, work *big.Int) *big.Int {
+	if work == nil {
+		var err error
+		if work, err = m.bc.GetChainWork(hash); err != nil {
+			fmt.Printf("获取区块%x的累计工作量失败: %v\n", hash, err)
+			return nil
+		}
+	}
+	if m.bestHeaderWork == nil || work.Cmp(m.bestHeaderWork) > 0 {
+		m.bestHeader = hash
+		m.bestHeaderHeight = height
+		m.bestHeaderWork = work
+	}
+	return work
+}
+
+// 丢掉不合法的分支以后，最好的区块头可能就在这条分支上
+// 重新从主链的tip和还要下载的区块里选出累计工作量最大的
+func (m *syncManager) resetBest() {
+	m.bestHeader = nil
+	m.bestHeaderHeight = 0
+	m.bestHeaderWork = nil
+	m.refreshBest()
+	for _, req := range m.requests {
+		m.considerBest(req.hash, req.height, req.work)
+	}
+}
+
+func (m *syncManager) peer(p *Peer) *peerState {
+	peer, ok := m.peers[p]
+	if !ok {
+		peer = &peerState{}
+		//连接断开以后还在处理的消息不能把节点再加回来
+		if !p.isClosed() {
+			m.peers[p] = peer
+		}
+	}
+	return peer
+}
+
+// 收到version消息，记录对方的高度，对方比自己高就开始同步
+func (m *syncManager) updatePeer(p *Peer, height int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if p.isClosed() {
+		return
+	}
+	m.refreshBest()
+	peer := m.peer(p)
+	if height > peer.height {
+		peer.height = height
+		peer.headersSynced = false
+	}
+	if m.headersPeer == nil && height > m.bestHeaderHeight {
+		m.requestHeaders(p)
+	}
+}
+
+// 对方通知有新区块，通过区块头找到它和本地链的分叉位置
+func (m *syncManager) onBlockInv(p *Peer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if p.isClosed() {
+		return
+	}
+	m.refreshBest()
+	m.peer(p).headersSynced = false
+	if m.headersPeer == nil {
+		m.requestHeaders(p)
+	}
+}
+
+// 向节点请求接在最高区块头后面的区块头
+func (m *syncManager) requestHeaders(p *Peer) {
+	m.headersPeer = p
+	m.headersTime = time.Now()
+	go m.node.SendGetHeaders(p, m.bc.BlockLocator(m.bestHeader))
+}
+
+// 收到一批区块头，逐个校验存储，需要下载的区块加入下载队列
+// 区块头不合法时返回错误，对方不再参与同步
+func (m *syncManager) onHeaders(p *Peer, items [][]byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.refreshBest()
+	peer := m.peer(p)
+	var headersErr error
+	for _, item := range items {
+		header, err := pbcc.DecodeBlockHeader(item)
+		if err != nil {
+			headersErr = misbehavior(conf.ScoreMalformedMessage, fmt.Errorf("区块头解析失败: %v", err))
+			break
+		}
+		hash, err := m.bc.AddHeader(header)
+		if err != nil {
+			headersErr = misbehavior(headerScore(err), fmt.Errorf("拒绝区块头: %w", err))
+			break
+		}
+		if header.Height > peer.height {
+			peer.height = header.Height
+		}
+		work := m.considerBest(hash, header.Height, nil)
+		if work != nil && !m.bc.HasBlock(hash) && m.findRequest(hash) < 0 {
+			m.requests = append(m.requests, &blockRequest{hash: hash, height: header.Height, work: work, stalled: make(map[*Peer]bool)})
+		}
+	}
+	sort.SliceStable(m.requests, func(i, j int) bool {
+		return m.requests[i].height < m.requests[j].height
+	})
+	if headersErr != nil {
+		peer.stalls = conf.MaxPeerStalls
+	}
+	if p == m.headersPeer {
+		m.headersPeer = nil
+		if headersErr == nil {
+			peer.stalls = 0
+		}
+		if headersErr == nil && len(items) == conf.MaxHeadersPerMsg {
+			//一次最多回复MaxHeadersPerMsg个，可能还有更多的区块头
+			m.requestHeaders(p)
+		} else {
+			//对方的区块头已经全部拿到了，它的链更长但是工作量更小时也不会反复向它请求
+			peer.headersSynced = headersErr == nil
+			m.requestHeadersFromBestPeer()
+		}
+	}
+	m.scheduleDownloads()
+	m.checkSyncDone()
+	return headersErr
+}
+
+// 是否正在同步区块头或者下载区块
+func (m *syncManager) isSyncing() bool {
+	return m.headersPeer != nil || len(m.requests) > 0
+}
+
+// 向节点请求交易池里的交易，正在同步时先记下来，同步完成后再请求
+func (m *syncManager) requestMempool(p *Peer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if p.isClosed() {
+		return
+	}
+	if !m.isSyncing() {
+		go m.node.SendMempool(p)
+		return
+	}
+	if !containsPeer(m.mempoolPeers, p) {
+		m.mempoolPeers = append(m.mempoolPeers, p)
+	}
+}
+
+// 同步完成了，向等待的节点请求交易池
+func (m *syncManager) checkSyncDone() {
+	if m.isSyncing() {
+		return
+	}
+	for _, p := range m.mempoolPeers {
+		go m.node.SendMempool(p)
+	}
+	m.mempoolPeers = nil
+}
+
+// 如果有节点比最好的区块头还高，并且还没有同步过它的区块头，继续向它同步区块头
+func (m *syncManager) requestHeadersFromBestPeer() {
+	for p, peer := range m.peers {
+		if peer.height > m.bestHeaderHeight && !peer.headersSynced && peer.stalls < conf.MaxPeerStalls {
+			m.requestHeaders(p)
+			return
+		}
+	}
+}
+
+func (m *syncManager) findRequest(hash []byte) int {
+	for i, req := range m.requests {
+		if bytes.Equal(req.hash, hash) {
+			return i
+		}
+	}
+	return -1
+}
+
+// 给还没有请求的区块分配节点：对方的高度要够，正在请求的区块最少的节点优先
+func (m *syncManager) scheduleDownloads() {
+	for _, req := range m.requests {
+		if req.peer != nil || req.block != nil {
+			continue
+		}
+		p := m.choosePeer(req)
+		if p == nil && len(req.stalled) > 0 {
+			//所有节点都超时过，再从头试一遍
+			req.stalled = make(map[*Peer]bool)
+			p = m.choosePeer(req)
+		}
+		if p == nil {
+			continue
+		}
+		req.peer = p
+		req.time = time.Now()
+		m.peers[p].inFlight++
+		go m.node.SendGetData(p, conf.BLOCK_TYPE, req.hash)
+	}
+}
+
+func (m *syncManager) choosePeer(req *blockRequest) *Peer {
+	var best *Peer
+	for p, peer := range m.peers {
+		if peer.height < req.height || peer.inFlight >= conf.MaxBlocksInFlightPerPeer {
+			continue
+		}
+		if peer.stalls >= conf.MaxPeerStalls || req.stalled[p] {
+			continue
+		}
+		if best == nil || peer.inFlight < m.peers[best].inFlight {
+			best = p
+		}
+	}
+	return best
+}
+
+// 收到区块，是同步请求的区块就返回true
+func (m *syncManager) onBlock(p *Peer, block *pbcc.Block) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	index := m.findRequest(block.Hash)
+	if index < 0 {
+		return false
+	}
+	req := m.requests[index]
+	if req.block != nil {
+		return true
+	}
+	if req.peer != nil {
+		m.peer(req.peer).inFlight--
+		req.peer = nil
+	}
+	m.peer(p).stalls = 0
+	req.block = block
+	req.from = p
+	m.connectBlocks()
+	m.scheduleDownloads()
+	m.checkSyncDone()
+	return true
+}
+
+// 对方没有请求的区块，换一个节点请求
+func (m *syncManager) onNotFound(p *Peer, hashes [][]byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, hash := range hashes {
+		index := m.findRequest(hash)
+		if index < 0 || m.requests[index].peer != p {
+			continue
+		}
+		req := m.requests[index]
+		m.peer(p).inFlight--
+		req.stalled[p] = true
+		req.peer = nil
+	}
+	m.scheduleDownloads()
+	m.checkSyncDone()
+}
+
+// 把上一个区块已经接入的区块依次接入
+// 下载队列空了以后把新的tip通知给其他节点，同步过程中的区块不逐个通知
+func (m *syncManager) connectBlocks() {
+	var newTip *pbcc.Block
+	defer func() {
+		if newTip != nil && len(m.requests) == 0 {
+			m.node.broadcastInv(conf.BLOCK_TYPE, [][]byte{newTip.Hash}, nil)
+		}
+	}()
+	for {
+		index := -1
+		for i, req := range m.requests {
+			if req.block != nil && m.bc.HasBlock(req.block.PrevBlockHash) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return
+		}
+		req := m.requests[index]
+		m.requests = append(m.requests[:index], m.requests[index+1:]...)
+		change, err := m.node.processBlock(req.block)
+		if change != nil {
+			newTip = req.block
+		}
+		if err == nil {
+			continue
+		}
+		fmt.Printf("拒绝区块 %x: %v\n", req.hash, err)
+		if score := blockScore(err); score > 0 {
+			//发来不合法区块的节点不再参与同步，断开连接会回到同步管理里，不能在持有锁的时候处理
+			m.peer(req.from).stalls = conf.MaxPeerStalls
+			go req.from.misbehaving(score, err.Error())
+		}
+		if errors.Is(err, pbcc.ErrBadMerkleRoot) || errors.Is(err, pbcc.ErrHashMismatch) {
+			//发来的数据和校验过的区块头对不上，区块头本身是合法的，换一个节点重新下载
+			req.block = nil
+			req.stalled[req.from] = true
+			m.requests = append(m.requests, req)
+			sort.SliceStable(m.requests, func(i, j int) bool {
+				return m.requests[i].height < m.requests[j].height
+			})
+			continue
+		}
+		m.dropDescendants(req.hash)
+		//最好的区块头可能在丢掉的分支上，不重新选的话比它低的节点都不会再被请求区块头
+		m.resetBest()
+		if m.headersPeer == nil {
+			m.requestHeadersFromBestPeer()
+		}
+	}
+}
+
+// 区块不合法，后面接在它上面的区块也都不用再下载了
+func (m *syncManager) dropDescendants(hash []byte) {
+	bad := map[string]bool{string(hash): true}
+	var requests []*blockRequest
+	for _, req := range m.requests {
+		header, err := m.bc.GetHeader(req.hash)
+		if err == nil && bad[string(header.PrevBlockHash)] {
+			bad[string(req.hash)] = true
+			if req.peer != nil {
+				m.peer(req.peer).inFlight--
+			}
+			continue
+		}
+		requests = append(requests, req)
+	}
+	m.requests = requests
+}
+
+// 请求超时的区块换一个节点请求，区块头请求超时就换一个节点同步
+func (m *syncManager) checkTimeouts() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for _, req := range m.requests {
+		if req.peer == nil || now.Sub(req.time) < conf.BlockDownloadTimeout {
+			continue
+		}
+		fmt.Printf("向节点%s请求区块%x超时\n", req.peer, req.hash)
+		peer := m.peer(req.peer)
+		peer.inFlight--
+		peer.stalls++
+		req.stalled[req.peer] = true
+		req.peer = nil
+	}
+	if m.headersPeer != nil && now.Sub(m.headersTime) >= conf.HeadersTimeout {
+		fmt.Printf("向节点%s请求区块头超时\n", m.headersPeer)
+		m.peer(m.headersPeer).stalls++
+		m.headersPeer = nil
+		m.requestHeadersFromBestPeer()
+	}
+	m.scheduleDownloads()
+	m.checkSyncDone()
+}
+
+// 把区块加入区块链，主链变化时更新交易池，矿工节点在新的tip上重新挖矿
+// 返回主链的变化，主链没有变化时为nil
+func (n *Node) processBlock(block *pbcc.Block) (*pbcc.TipChange, error) {
+	change, err := n.chain.AddBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Added block %x\n", block.Hash)
+	n.txPool.ProcessTipChange(change)
+	n.markTxPoolDirty()
+	// 主链tip变了，之前的挖矿已经过时，在新的tip上重新开始
+	if change != nil && len(n.minerAddress) > 0 {
+		n.restartMining()
+	}
+	return change, nil
+}
@@ -0,0 +1,222 @@
+package simulator
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 连接因为丢包或者网络分区被重置
+var ErrConnReset = errors.New("连接被重置")
+
+// 读取超时，和net包一样实现了net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "读取超时" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// 内存连接的地址
+type memAddr string
+
+func (addr memAddr) Network() string { return "mem" }
+func (addr memAddr) String() string  { return string(addr) }
+
+// 一次Write写入的数据，到了at时间对方才能读到
+type packet struct {
+	data []byte
+	at   time.Time
+}
+
+// 连接的一个方向，按写入的顺序投递
+type pipe struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	packets  []packet
+	buf      []byte    // 已经投递还没有读完的数据
+	last     time.Time // 最后一个包的投递时间，后面的包不能比它早
+	closed   bool      // 写的一方关闭了连接，读完剩下的数据后返回EOF
+	reset    bool      // 连接被重置，没读的数据丢掉
+	deadline time.Time // 读取的截止时间
+}
+
+func newPipe() *pipe {
+	p := &pipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// 写入数据，delay之后对方才能读到
+func (p *pipe) write(data []byte, delay time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reset || p.closed {
+		return ErrConnReset
+	}
+	at := time.Now().Add(delay)
+	if at.Before(p.last) {
+		at = p.last
+	}
+	p.last = at
+	p.packets = append(p.packets, packet{append([]byte(nil), data...), at})
+	p.wakeAt(at)
+	return nil
+}
+
+// 到了t时间唤醒正在等待的读取
+func (p *pipe) wakeAt(t time.Time) {
+	time.AfterFunc(time.Until(t), func() {
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.reset {
+			return 0, ErrConnReset
+		}
+		if len(p.buf) > 0 {
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			return n, nil
+		}
+		now := time.Now()
+		if len(p.packets) > 0 && !p.packets[0].at.After(now) {
+			p.buf = p.packets[0].data
+			p.packets = p.packets[1:]
+			continue
+		}
+		if len(p.packets) == 0 && p.closed {
+			return 0, io.EOF
+		}
+		if !p.deadline.IsZero() && !p.deadline.After(now) {
+			return 0, timeoutError{}
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *pipe) setDeadline(t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	if !t.IsZero() {
+		p.wakeAt(t)
+	}
+	p.cond.Broadcast()
+}
+
+// 写的一方关闭，对方读完已经写入的数据后返回EOF
+func (p *pipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// 重置，双方马上出错
+func (p *pipe) resetNow() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reset = true
+	p.packets = nil
+	p.buf = nil
+	p.cond.Broadcast()
+}
+
+// 两个节点之间的一条连接
+type link struct {
+	network *Network
+	from    string // 主动连接的节点地址
+	to      string // 被连接的节点地址
+	forward *pipe  // from -> to
+	back    *pipe  // to -> from
+}
+
+// 重置连接，两个方向都出错
+func (l *link) reset() {
+	l.forward.resetNow()
+	l.back.resetNow()
+	l.network.removeLink(l)
+}
+
+// 连接的一端，实现了net.Conn
+type memConn struct {
+	link       *link
+	in         *pipe
+	out        *pipe
+	localAddr  memAddr
+	remoteAddr memAddr
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	n, err := c.in.read(b)
+	if err != nil && c.isClosed() {
+		return n, net.ErrClosed
+	}
+	return n, err
+}
+
+// 写入不会阻塞，按网络的设置延迟投递，丢包时整条连接被重置
+func (c *memConn) Write(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	delay, drop := c.link.network.nextDelivery()
+	if drop {
+		c.link.reset()
+		return 0, ErrConnReset
+	}
+	if err := c.out.write(b, delay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.out.close()
+	// 自己这一端不再读，正在等待的读取马上返回
+	c.in.resetNow()
+	c.link.network.removeLink(c.link)
+	return nil
+}
+
+func (c *memConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *memConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// 写入不会阻塞，不需要截止时间
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,216 @@
+package simulator
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"publicchain/server"
+	"sync"
+	"time"
+)
+
+// 进程内的网络，节点之间的连接都在内存里
+// 可以设置投递延迟和丢包率，也可以把节点分成互相不通的分区
+// 节点之间是可靠的字节流，和TCP一样不会只丢掉一段数据，所以丢包时整条连接被重置
+type Network struct {
+	mu        sync.Mutex
+	rand      *rand.Rand
+	latency   time.Duration // 每个包的基本延迟
+	jitter    time.Duration // 在基本延迟上随机增加0到jitter
+	dropRate  float64       // 每个包被丢掉的概率
+	dropped   int           // 已经被丢掉的包的数量
+	listeners map[string]*listener
+	links     map[*link]bool
+	groups    map[string]int // 节点地址 -> 分区编号，为nil表示没有分区
+	nextID    int
+}
+
+// 创建网络，seed相同时延迟和丢包的随机结果相同
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:      rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*listener),
+		links:     make(map[*link]bool),
+	}
+}
+
+// 设置每个包的延迟：latency加上0到jitter之间的随机值
+func (network *Network) SetLatency(latency, jitter time.Duration) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.latency = latency
+	network.jitter = jitter
+}
+
+// 设置丢包率，0到1之间
+func (network *Network) SetDropRate(rate float64) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.dropRate = rate
+}
+
+// 到目前为止被丢掉的包的数量，每丢一个包就有一条连接被重置
+func (network *Network) Dropped() int {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	return network.dropped
+}
+
+// 把节点分成几个分区，不同分区的节点不能连接，已经建立的跨分区连接被重置
+// 没有出现在任何分区里的节点属于同一个分区
+func (network *Network) Partition(groups ...[]string) {
+	network.mu.Lock()
+	network.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			network.groups[addr] = i + 1
+		}
+	}
+	var cut []*link
+	for l := range network.links {
+		if !network.reachableLocked(l.from, l.to) {
+			cut = append(cut, l)
+		}
+	}
+	network.mu.Unlock()
+	for _, l := range cut {
+		l.reset()
+	}
+}
+
+// 取消分区，所有节点又可以互相连接
+func (network *Network) Heal() {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.groups = nil
+}
+
+// 两个节点之间是否可以通信
+func (network *Network) Reachable(from, to string) bool {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	return network.reachableLocked(from, to)
+}
+
+func (network *Network) reachableLocked(from, to string) bool {
+	return network.groups == nil || network.groups[from] == network.groups[to]
+}
+
+// 节点addr使用的Transport，连接的本地地址就是addr
+func (network *Network) Transport(addr string) server.Transport {
+	return &transport{network, addr}
+}
+
+// 下一个包的延迟，以及它是否被丢掉
+func (network *Network) nextDelivery() (time.Duration, bool) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	if network.dropRate > 0 && network.rand.Float64() < network.dropRate {
+		network.dropped++
+		return 0, true
+	}
+	delay := network.latency
+	if network.jitter > 0 {
+		delay += time.Duration(network.rand.Int63n(int64(network.jitter)))
+	}
+	return delay, false
+}
+
+func (network *Network) removeLink(l *link) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	delete(network.links, l)
+}
+
+// 建立从from到to的连接，返回from这一端
+func (network *Network) dial(from, to string, timeout time.Duration) (net.Conn, error) {
+	network.mu.Lock()
+	ln, ok := network.listeners[to]
+	if !ok {
+		network.mu.Unlock()
+		return nil, fmt.Errorf("连接%s失败: 没有节点在监听", to)
+	}
+	if !network.reachableLocked(from, to) {
+		network.mu.Unlock()
+		return nil, fmt.Errorf("连接%s失败: 网络分区", to)
+	}
+	network.nextID++
+	id := network.nextID
+	l := &link{network: network, from: from, to: to, forward: newPipe(), back: newPipe()}
+	network.links[l] = true
+	network.mu.Unlock()
+	// 同一个节点可能有多条连接，本地地址后面加上连接的编号
+	local := memAddr(fmt.Sprintf("%s#%d", from, id))
+	client := &memConn{link: l, in: l.back, out: l.forward, localAddr: local, remoteAddr: memAddr(to)}
+	serverSide := &memConn{link: l, in: l.forward, out: l.back, localAddr: memAddr(to), remoteAddr: local}
+	select {
+	case ln.conns <- serverSide:
+		return client, nil
+	case <-ln.closed:
+		l.reset()
+		return nil, fmt.Errorf("连接%s失败: 节点已经停止监听", to)
+	case <-time.After(timeout):
+		l.reset()
+		return nil, fmt.Errorf("连接%s超时", to)
+	}
+}
+
+// 一个节点使用的Transport
+type transport struct {
+	network *Network
+	addr    string
+}
+
+func (t *transport) Listen(addr string) (net.Listener, error) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	if _, ok := t.network.listeners[addr]; ok {
+		return nil, fmt.Errorf("地址%s已经被占用", addr)
+	}
+	ln := &listener{
+		network: t.network,
+		addr:    memAddr(addr),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	t.network.listeners[addr] = ln
+	return ln, nil
+}
+
+func (t *transport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return t.network.dial(t.addr, addr, timeout)
+}
+
+// 监听的地址，实现了net.Listener
+type listener struct {
+	network   *Network
+	addr      memAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *listener) Close() error {
+	ln.closeOnce.Do(func() {
+		close(ln.closed)
+		ln.network.mu.Lock()
+		if ln.network.listeners[string(ln.addr)] == ln {
+			delete(ln.network.listeners, string(ln.addr))
+		}
+		ln.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (ln *listener) Addr() net.Addr {
+	return ln.addr
+}
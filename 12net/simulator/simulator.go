@@ -0,0 +1,422 @@
+package simulator
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"publicchain/addrbook"
+	"publicchain/conf"
+	"publicchain/crypto"
+	"publicchain/mempool"
+	"publicchain/pbcc"
+	"publicchain/server"
+	"publicchain/wallet"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 一个进程里运行多个节点的模拟器，节点之间通过内存里的Network通信，可以在go test里使用：
+//
+//	sim, err := simulator.New(simulator.Config{Nodes: 3})
+//	defer sim.Stop()
+//	sim.ConnectAll()
+//	sim.Mine(0, 5)
+//	sim.AssertConverged(t, 30*time.Second)
+//
+// 节点都不设置矿工地址，只有调用Mine时才挖矿，哪个节点在什么时候挖出区块是确定的
+// 挖矿只用一个goroutine，区块时间戳来自模拟的时钟，矿工的私钥由Seed生成，
+// 所以Seed相同、调用Mine的顺序相同时，挖出来的区块和每个节点的tip都相同
+type Config struct {
+	Nodes    int           // 节点数量
+	Seed     int64         // 网络的随机数种子
+	Latency  time.Duration // 每个包的基本延迟
+	Jitter   time.Duration // 在基本延迟上随机增加0到Jitter
+	DropRate float64       // 丢包率，丢包时连接被重置
+	Dir      string        // 存放数据库的目录，为空时创建临时目录，Stop时删除
+}
+
+// 多久检查一次节点之间的连接，断开的连接重新建立
+const reconnectInterval = 200 * time.Millisecond
+
+// 多久检查一次是否收敛
+const pollInterval = 50 * time.Millisecond
+
+// 模拟时钟的起始时间，也是创世区块的时间戳
+var genesisTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Assert系列方法需要的testing.TB的一部分，*testing.T和*testing.B都满足
+// 模拟器不直接依赖testing包，普通程序里也可以使用
+type TB interface {
+	Helper()
+	Fatal(args ...interface{})
+}
+
+// 模拟的时钟：每挖一个区块前进一个期望的出块间隔
+// 区块时间戳只由挖矿的顺序决定，难度调整不会受测试运行快慢的影响
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// 给下一个区块用的时间
+func (c *clock) next() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(conf.TargetBlockSpacing * time.Second)
+	return c.now
+}
+
+// 用种子生成矿工的钱包，种子相同时私钥和地址都相同
+func newMinerWallet(seed int64) *wallet.Wallet {
+	var seedBytes [8]byte
+	binary.BigEndian.PutUint64(seedBytes[:], uint64(seed))
+	sum := sha256.Sum256(seedBytes[:])
+	curve := elliptic.P256()
+	//私钥在1到N-1之间
+	one := big.NewInt(1)
+	d := new(big.Int).SetBytes(sum[:])
+	d.Mod(d, new(big.Int).Sub(curve.Params().N, one))
+	d.Add(d, one)
+	private := ecdsa.PrivateKey{D: d}
+	private.Curve = curve
+	private.X, private.Y = curve.ScalarBaseMult(d.Bytes())
+	pubKey := append(private.X.Bytes(), private.Y.Bytes()...)
+	return &wallet.Wallet{PrivateKey: private, PublicKey: pubKey}
+}
+
+type Simulator struct {
+	Network      *Network
+	Nodes        []*server.Node
+	MinerAddress string // 挖矿奖励的地址，创世区块的奖励也给它
+
+	miner   *wallet.Wallet
+	clock   *clock
+	dir     string
+	tempDir bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu    sync.Mutex
+	edges map[[2]int]bool // 要保持的连接，断开后自动重连
+}
+
+// 创建模拟器：所有节点使用同一个创世区块，区块链数据库放在Dir里，其他状态只在内存里
+func New(config Config) (*Simulator, error) {
+	if config.Nodes <= 0 {
+		return nil, fmt.Errorf("节点数量%d不对", config.Nodes)
+	}
+	dir := config.Dir
+	tempDir := dir == ""
+	if tempDir {
+		var err error
+		dir, err = ioutil.TempDir("", "publicchain-sim")
+		if err != nil {
+			return nil, err
+		}
+	}
+	network := NewNetwork(config.Seed)
+	network.SetLatency(config.Latency, config.Jitter)
+	network.SetDropRate(config.DropRate)
+	ctx, cancel := context.WithCancel(context.Background())
+	miner := newMinerWallet(config.Seed)
+	sim := &Simulator{
+		Network:      network,
+		MinerAddress: string(miner.GetAddress()),
+		miner:        miner,
+		clock:        &clock{now: genesisTime},
+		dir:          dir,
+		tempDir:      tempDir,
+		ctx:          ctx,
+		cancel:       cancel,
+		edges:        make(map[[2]int]bool),
+	}
+	genesisTxs := []*pbcc.Transaction{pbcc.NewCoinBaseTransaction(sim.MinerAddress, 0, 0)}
+	genesisOpts := pbcc.MiningOptions{Workers: 1, Now: func() time.Time { return genesisTime }}
+	genesis, err := pbcc.MineBlock(ctx, genesisTxs, make([]byte, 32), 0, pbcc.PowLimitBits(), genesisOpts)
+	if err != nil {
+		sim.Stop()
+		return nil, err
+	}
+	for i := 0; i < config.Nodes; i++ {
+		node, err := sim.newNode(i, genesis)
+		if err != nil {
+			sim.Stop()
+			return nil, err
+		}
+		sim.Nodes = append(sim.Nodes, node)
+	}
+	return sim, nil
+}
+
+// 创建第i个节点，区块链从创世区块开始
+func (sim *Simulator) newNode(i int, genesis *pbcc.Block) (*server.Node, error) {
+	nodeID := fmt.Sprintf("sim%d", i)
+	dbPath := filepath.Join(sim.dir, fmt.Sprintf(conf.DBNAME, nodeID))
+	if err := pbcc.CreateBlockChainAt(dbPath, genesis); err != nil {
+		return nil, err
+	}
+	bc, err := pbcc.OpenBlockChainAt(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	(&pbcc.UTXOSet{BlockChain: bc}).ResetUTXOSet()
+	key, err := crypto.NewNodeKey()
+	if err != nil {
+		bc.Close()
+		return nil, err
+	}
+	address := fmt.Sprintf("sim%d:%d", i, 8000+i)
+	node := server.NewNode(server.Config{
+		NodeID:    nodeID,
+		Address:   address,
+		Chain:     bc,
+		Mempool:   mempool.New(bc),
+		Transport: sim.Network.Transport(address),
+		NodeKey:   key,
+		AddrBook:  addrbook.New(),
+		BanList:   addrbook.NewBanList(),
+
+		MiningWorkers: 1,
+		MiningClock:   sim.clock.next,
+	})
+	if err := node.Start(sim.ctx); err != nil {
+		bc.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// 第i个节点的地址
+func (sim *Simulator) Addr(i int) string {
+	return sim.Nodes[i].Address()
+}
+
+// 让节点i主动连接节点j，之后连接断开了会自动重连
+func (sim *Simulator) Connect(i, j int) error {
+	sim.mu.Lock()
+	first := len(sim.edges) == 0
+	sim.edges[[2]int{i, j}] = true
+	sim.mu.Unlock()
+	if first {
+		sim.wg.Add(1)
+		go sim.reconnectLoop()
+	}
+	return sim.Nodes[i].Connect(sim.Addr(j))
+}
+
+// 每两个节点之间都建立连接
+func (sim *Simulator) ConnectAll() error {
+	for i := range sim.Nodes {
+		for j := i + 1; j < len(sim.Nodes); j++ {
+			if err := sim.Connect(i, j); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 把节点按编号分成几个分区，分区之间的连接被重置，Heal之后自动重连
+func (sim *Simulator) Partition(groups ...[]int) {
+	var addrGroups [][]string
+	for _, group := range groups {
+		var addrs []string
+		for _, i := range group {
+			addrs = append(addrs, sim.Addr(i))
+		}
+		addrGroups = append(addrGroups, addrs)
+	}
+	sim.Network.Partition(addrGroups...)
+}
+
+// 取消分区
+func (sim *Simulator) Heal() {
+	sim.Network.Heal()
+}
+
+// 定时检查要保持的连接，断开的、网络可达的重新连接
+func (sim *Simulator) reconnectLoop() {
+	defer sim.wg.Done()
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-sim.ctx.Done():
+			return
+		}
+		sim.mu.Lock()
+		var edges [][2]int
+		for edge := range sim.edges {
+			edges = append(edges, edge)
+		}
+		sim.mu.Unlock()
+		for _, edge := range edges {
+			from, to := sim.Addr(edge[0]), sim.Addr(edge[1])
+			if sim.Network.Reachable(from, to) && !sim.connected(edge[0], to) {
+				sim.Nodes[edge[0]].Connect(to)
+			}
+		}
+	}
+}
+
+// 节点i是否和addr完成了握手
+func (sim *Simulator) connected(i int, addr string) bool {
+	for _, peer := range sim.Nodes[i].Peers() {
+		if peer == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// 等待所有要保持的连接都完成握手
+func (sim *Simulator) WaitForPeers(timeout time.Duration) error {
+	return sim.waitFor(timeout, func() error {
+		sim.mu.Lock()
+		defer sim.mu.Unlock()
+		for edge := range sim.edges {
+			if !sim.connected(edge[0], sim.Addr(edge[1])) {
+				return fmt.Errorf("节点%d和节点%d还没有完成握手", edge[0], edge[1])
+			}
+		}
+		return nil
+	})
+}
+
+// 节点i连续挖count个区块，交易池里的交易也会被打包，挖出的区块会通知其他节点
+func (sim *Simulator) Mine(i int, count int) ([]*pbcc.Block, error) {
+	var blocks []*pbcc.Block
+	for n := 0; n < count; n++ {
+		block, err := sim.Nodes[i].GenerateBlock(sim.ctx, sim.MinerAddress)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// 在节点i上创建一笔从矿工地址转账到to的交易并提交，返回交易
+// 只花节点i主链上已经成熟、交易池里还没有被花掉的矿工UTXO，余额不够时返回错误
+func (sim *Simulator) SendTransaction(i int, to string, amount, fee int64) (*pbcc.Transaction, error) {
+	node := sim.Nodes[i]
+	bc := node.Chain().(*pbcc.BlockChain)
+	spent := make(map[string]bool)
+	for _, tx := range node.Mempool().Transactions() {
+		for _, in := range tx.Vins {
+			spent[fmt.Sprintf("%x:%d", in.TxID, in.Vout)] = true
+		}
+	}
+	spendHeight := bc.GetBestHeight() + 1
+	var txInputs []*pbcc.TXInput
+	var balance int64
+	utxoSet := &pbcc.UTXOSet{BlockChain: bc}
+	for _, utxo := range utxoSet.FindUnspentOutputsForAddress(sim.MinerAddress) {
+		if balance >= amount+fee {
+			break
+		}
+		if !utxo.IsMature(spendHeight) || spent[fmt.Sprintf("%x:%d", utxo.TxID, utxo.Index)] {
+			continue
+		}
+		txInputs = append(txInputs, &pbcc.TXInput{TxID: utxo.TxID, Vout: utxo.Index, PublicKey: sim.miner.PublicKey})
+		balance += utxo.Output.Value
+	}
+	if balance < amount+fee {
+		return nil, fmt.Errorf("节点%d上矿工可以花的余额%d不够%d", i, balance, amount+fee)
+	}
+	txOutputs := []*pbcc.TXOuput{pbcc.NewTXOuput(amount, to)}
+	if change := balance - amount - fee; change > 0 {
+		txOutputs = append(txOutputs, pbcc.NewTXOuput(change, sim.MinerAddress))
+	}
+	tx := &pbcc.Transaction{TxID: []byte{}, Vins: txInputs, Vouts: txOutputs}
+	tx.SetTxID()
+	bc.SignTransaction(tx, sim.miner.PrivateKey, nil)
+	if err := node.SubmitTransaction(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// 每个节点主链tip的hash
+func (sim *Simulator) Tips() []string {
+	var tips []string
+	for _, node := range sim.Nodes {
+		tips = append(tips, fmt.Sprintf("%x", node.Chain().GetTipHash()))
+	}
+	return tips
+}
+
+// 等待所有节点的主链tip相同，超时返回错误，错误里有每个节点的高度和tip
+func (sim *Simulator) WaitForConvergence(timeout time.Duration) error {
+	return sim.waitFor(timeout, func() error {
+		tips := sim.Tips()
+		for _, tip := range tips[1:] {
+			if tip != tips[0] {
+				var lines []string
+				for i, node := range sim.Nodes {
+					lines = append(lines, fmt.Sprintf("节点%d 高度:%d tip:%s", i, node.Chain().GetBestHeight(), tips[i]))
+				}
+				return fmt.Errorf("节点没有收敛:\n%s", strings.Join(lines, "\n"))
+			}
+		}
+		return nil
+	})
+}
+
+// 所有节点在timeout之内收敛到同一个tip，否则测试失败
+func (sim *Simulator) AssertConverged(t TB, timeout time.Duration) {
+	t.Helper()
+	if err := sim.WaitForConvergence(timeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 所有节点的交易池在timeout之内都有这笔交易，否则测试失败
+func (sim *Simulator) AssertTxRelayed(t TB, txID []byte, timeout time.Duration) {
+	t.Helper()
+	err := sim.waitFor(timeout, func() error {
+		for i, node := range sim.Nodes {
+			if !node.Mempool().Has(txID) {
+				return fmt.Errorf("节点%d的交易池里没有交易%x", i, txID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 定时检查check，直到它返回nil或者超时，超时返回最后一次的错误
+func (sim *Simulator) waitFor(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// 停止所有节点，关闭数据库，删除临时目录
+func (sim *Simulator) Stop() {
+	sim.cancel()
+	sim.wg.Wait()
+	for _, node := range sim.Nodes {
+		node.Stop()
+	}
+	if sim.tempDir {
+		os.RemoveAll(sim.dir)
+	}
+}
@@ -0,0 +1,164 @@
+package simulator_test
+
+import (
+	"bytes"
+	"publicchain/conf"
+	"publicchain/pbcc"
+	"publicchain/simulator"
+	"testing"
+	"time"
+)
+
+// 等待收敛、交易转发的超时时间
+const waitTimeout = 30 * time.Second
+
+// 创建n个两两相连的节点，测试结束时停止
+func startSimulator(t *testing.T, n int) *simulator.Simulator {
+	t.Helper()
+	sim, err := simulator.New(simulator.Config{Nodes: n, Seed: 1, Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Stop)
+	if err := sim.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.WaitForPeers(waitTimeout); err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func mine(t *testing.T, sim *simulator.Simulator, i int, count int) []*pbcc.Block {
+	t.Helper()
+	blocks, err := sim.Mine(i, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+// 所有节点的主链tip都是block
+func assertTip(t *testing.T, sim *simulator.Simulator, block *pbcc.Block) {
+	t.Helper()
+	for i, node := range sim.Nodes {
+		if tip := node.Chain().GetTipHash(); !bytes.Equal(tip, block.Hash) {
+			t.Fatalf("节点%d的tip是%x，应该是高度%d的%x", i, tip, block.Height, block.Hash)
+		}
+	}
+}
+
+// 定时检查cond，timeout之内没有成立时测试失败
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestConvergence(t *testing.T) {
+	sim := startSimulator(t, 3)
+	blocks := mine(t, sim, 0, 12)
+	sim.AssertConverged(t, waitTimeout)
+	assertTip(t, sim, blocks[len(blocks)-1])
+
+	//另一个节点接着挖，其他节点也要跟上
+	blocks = mine(t, sim, 2, 3)
+	sim.AssertConverged(t, waitTimeout)
+	assertTip(t, sim, blocks[len(blocks)-1])
+}
+
+func TestPartitionReorg(t *testing.T) {
+	sim := startSimulator(t, 3)
+	mine(t, sim, 0, 2)
+	sim.AssertConverged(t, waitTimeout)
+
+	//分区以后两边各自挖矿，节点0所在的分区链更短
+	sim.Partition([]int{0}, []int{1, 2})
+	minority := mine(t, sim, 0, 2)
+	majority := mine(t, sim, 2, 3)
+	if tip := sim.Nodes[0].Chain().GetTipHash(); !bytes.Equal(tip, minority[1].Hash) {
+		t.Fatalf("分区时节点0的tip是%x，应该是它自己挖的%x", tip, minority[1].Hash)
+	}
+
+	//恢复以后节点0要重组到更长的链上，它自己挖的区块不再在主链上
+	sim.Heal()
+	sim.AssertConverged(t, waitTimeout)
+	assertTip(t, sim, majority[2])
+	chain := sim.Nodes[0].Chain()
+	for _, block := range majority {
+		hash, err := chain.GetBlockHashByHeight(block.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash, block.Hash) {
+			t.Fatalf("节点0高度%d的区块是%x，应该是%x", block.Height, hash, block.Hash)
+		}
+	}
+}
+
+func TestTxRelay(t *testing.T) {
+	sim := startSimulator(t, 3)
+	//创世区块的coinbase成熟以后才能花
+	mine(t, sim, 0, conf.CoinbaseMaturity+2)
+	sim.AssertConverged(t, waitTimeout)
+
+	tx, err := sim.SendTransaction(1, sim.MinerAddress, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.AssertTxRelayed(t, tx.TxID, waitTimeout)
+
+	//另一个节点把交易打包，所有节点的交易池都要把它删掉
+	blocks := mine(t, sim, 2, 1)
+	if txs := blocks[0].Txs; len(txs) != 2 || !bytes.Equal(txs[1].TxID, tx.TxID) {
+		t.Fatalf("区块里应该只有coinbase和交易%x", tx.TxID)
+	}
+	sim.AssertConverged(t, waitTimeout)
+	for _, node := range sim.Nodes {
+		mempool := node.Mempool()
+		waitUntil(t, waitTimeout, func() bool { return !mempool.Has(tx.TxID) }, "交易打包以后还在交易池里")
+	}
+}
+
+func TestMessageDrop(t *testing.T) {
+	sim := startSimulator(t, 3)
+	mine(t, sim, 0, 2)
+	sim.AssertConverged(t, waitTimeout)
+
+	//丢包时连接被重置，一直挖到确实丢过包为止
+	sim.Network.SetDropRate(0.05)
+	var blocks []*pbcc.Block
+	for len(blocks) < 3 || sim.Network.Dropped() == 0 {
+		if len(blocks) >= 30 {
+			t.Fatal("挖了30个区块还没有丢过包")
+		}
+		blocks = append(blocks, mine(t, sim, 1, 1)...)
+	}
+
+	//不再丢包以后，节点重新连接并同步到同一个tip
+	sim.Network.SetDropRate(0)
+	sim.AssertConverged(t, 2*waitTimeout)
+	assertTip(t, sim, blocks[len(blocks)-1])
+}
+
+func TestDeterministicMining(t *testing.T) {
+	var chains [2][]*pbcc.Block
+	for i := range chains {
+		sim, err := simulator.New(simulator.Config{Nodes: 1, Seed: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chains[i] = mine(t, sim, 0, 5)
+		sim.Stop()
+	}
+	for i, block := range chains[0] {
+		if other := chains[1][i]; !bytes.Equal(block.Hash, other.Hash) {
+			t.Fatalf("种子相同时高度%d的区块不同: %x %x", block.Height, block.Hash, other.Hash)
+		}
+	}
+}
@@ -56,6 +56,12 @@ func NewWallet() *Wallet {
 func (w *Wallet) GetAddress() []byte {
 	//先将公钥进行一次hash256，一次160,得到pubKeyHash
 	pubKeyHash := PubKeyHash(w.PublicKey)
+	return PubKeyHashToAddress(pubKeyHash)
+
+}
+
+//根据pubKeyHash得到地址，交易输出里只有pubKeyHash
+func PubKeyHashToAddress(pubKeyHash []byte) []byte {
 	//添加版本号
 	versioned_payload := append([]byte{conf.Version}, pubKeyHash...)
 	// 获取校验和，将pubKeyhash，两次sha256后，取前4位
@@ -64,7 +70,6 @@ func (w *Wallet) GetAddress() []byte {
 	//Base58
 	address := crypto.Base58Encode(full_payload)
 	return address
-
 }
 
 //一次sha256,再一次ripemd160,得到publicKeyHash
@@ -90,6 +95,10 @@ func CheckSum(payload []byte) []byte {
 //判断地址是否有效
 func IsValidForAddress(address []byte) bool {
 	full_payload := crypto.Base58Decode(address)
+	//太短的地址连校验和都放不下
+	if len(full_payload) <= conf.AddressChecksumLen {
+		return false
+	}
 	checkSumBytes := full_payload[len(full_payload)-conf.AddressChecksumLen:]
 	versioned_payload := full_payload[:len(full_payload)-conf.AddressChecksumLen]
 	checkBytes := CheckSum(versioned_payload)